@@ -1,22 +1,30 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	urlu "net/url"
 	"os"
 	"os/signal"
+	"path"
 	"strings"
 	"syscall"
 	"time"
@@ -30,33 +38,179 @@ import (
 
 // Key is the object returned by theo-node
 type Key struct {
-	PublicKey    string `json:"public_key"`
-	PublicKeySig string `json:"public_key_sig"`
-	Account      string `json:"email"`
-	SSHOptions   string `json:"ssh_options"`
+	PublicKey        string `json:"public_key" yaml:"public_key"`
+	PublicKeySig     string `json:"public_key_sig" yaml:"public_key_sig"`
+	SignatureVersion int    `json:"signature_version,omitempty" yaml:"signature_version"`
+	Account          string `json:"email" yaml:"email"`
+	SSHOptions       string `json:"ssh_options" yaml:"ssh_options"`
+	// KeyID is the ID, or fingerprint, of the public key that made PublicKeySig
+	KeyID string `json:"key_id,omitempty" yaml:"key_id"`
+	// NotBefore and ExpiresAt (RFC 3339) limit when the key can be used, they are covered by SignatureV3
+	NotBefore string `json:"not_before,omitempty" yaml:"not_before"`
+	ExpiresAt string `json:"expires_at,omitempty" yaml:"expires_at"`
+	// Signatures holds additional signatures, by other signers, of the same payload as PublicKeySig
+	Signatures []KeySignature `json:"signatures,omitempty" yaml:"signatures"`
+	// VerifiedBy lists the trusted keys that vouched for this key, set by verifyKeys
+	VerifiedBy []string `json:"-" yaml:"-"`
+	// Source tells where the key comes from, one of the K_SOURCE_* constants or a static keys file
+	Source string `json:"-" yaml:"-"`
+	// Server is the Theo server which returned the key
+	Server string `json:"-" yaml:"-"`
 }
 
+// KeySignature is an additional signature of a Key
+type KeySignature struct {
+	Signature string `json:"signature" yaml:"signature"`
+	KeyID     string `json:"key_id,omitempty" yaml:"key_id"`
+}
+
+// keySignature is a decoded signature, KeyID is the ID or fingerprint of the signing key, if known
+type keySignature struct {
+	KeyID     string
+	Signature []byte
+}
+
+const (
+	// SignatureV1 is the legacy scheme: only the public key is signed
+	SignatureV1 = 1
+	// SignatureV2 signs public key, ssh options, account, user and host
+	SignatureV2 = 2
+	// SignatureV3 signs the same fields as SignatureV2, plus not_before and expires_at
+	SignatureV3 = 3
+)
+
+// signatureV2Payload is the wire encoded (RFC 4251 strings) message signed by SignatureV2
+type signatureV2Payload struct {
+	Magic      string
+	PublicKey  string
+	SSHOptions string
+	Account    string
+	User       string
+	Host       string
+}
+
+const signatureV2Magic = "theo-agent-sig-v2"
+
+// signatureV3Payload is the wire encoded (RFC 4251 strings) message signed by SignatureV3
+type signatureV3Payload struct {
+	Magic      string
+	PublicKey  string
+	SSHOptions string
+	Account    string
+	User       string
+	Host       string
+	NotBefore  string
+	ExpiresAt  string
+}
+
+const signatureV3Magic = "theo-agent-sig-v3"
+
 type StringArray []string
 
 type Config struct {
-	URL            string `yaml:"url"`
+	URL            StringArray `yaml:"url"`
 	Token          string
 	Cachedir       string
 	Verify         bool
-	PublicKey      StringArray `yaml:"public_key"`
+	PublicKey      PublicKeyList `yaml:"public_key"`
 	Timeout        int64
 	HostnamePrefix string `yaml:"hostname-prefix"`
 	HostnameSuffix string `yaml:"hostname-suffix"`
+	// AllowLegacySignatures accepts v1 signatures, which only cover the public key
+	AllowLegacySignatures bool `yaml:"allow_legacy_signatures"`
+	// VerifyQuorum is the number of distinct public keys that must have signed a key (default 1)
+	VerifyQuorum int `yaml:"verify_quorum"`
+	// VerifyQuorumHosts overrides VerifyQuorum for hostnames matching a pattern, first match wins
+	VerifyQuorumHosts []QuorumOverride `yaml:"verify_quorum_hosts"`
+	// SignatureNamespace is the namespace of SSHSIG signatures (default "theo")
+	SignatureNamespace string `yaml:"signature_namespace"`
+	// CheckRevocations fetches the revocation list and drops revoked keys, even when read from cache.
+	// When no revocation list, fetched or cached, is available every key is dropped
+	CheckRevocations bool `yaml:"check_revocations"`
+	// ExpiryTimeOption adds the expiry-time option to keys with expires_at (requires OpenSSH 7.7)
+	ExpiryTimeOption bool `yaml:"expiry_time_option"`
+	// URLOrder is the order Theo servers in url are tried: "ordered" (default), or "random" starting from the last server which answered
+	URLOrder string `yaml:"url_order"`
+	// HostCertificateReloadCommand is run after host certificates have been renewed, e.g. [systemctl, reload, sshd]
+	HostCertificateReloadCommand []string `yaml:"host_certificate_reload_command"`
+	// SourcePolicy restricts, locally, the client addresses keys can be used from
+	SourcePolicy []SourceRule `yaml:"source_policy"`
+	// MandatorySSHOptions are merged into the options of every key, e.g. no-port-forwarding,from="10.0.0.0/8"
+	MandatorySSHOptions string `yaml:"mandatory_ssh_options"`
+	// ForbiddenSSHOptions lists the option names, e.g. permitopen, that get a key dropped
+	ForbiddenSSHOptions []string `yaml:"forbidden_ssh_options"`
+	// KeyPolicy restricts the accepted key types and sizes
+	KeyPolicy KeyPolicy `yaml:"key_policy"`
+	// Access restricts, locally, the accounts allowed to log in as each user
+	Access AccessPolicy `yaml:"access"`
+	// Schedule limits when accounts can log in
+	Schedule []ScheduleRule `yaml:"schedule"`
+	// BreakGlass holds signed emergency keys, used only when no Theo server answers and there is no cache.
+	// They are signed like keys from Theo server (v2 or v3), for a login user and this host: every host needs its own.
+	BreakGlass []Key `yaml:"break_glass"`
+	// StaticKeys maps users to keys merged with the keys from Theo server
+	StaticKeys map[string][]Key `yaml:"static_keys"`
+	// StaticKeysDir holds the static keys of each user in <user>/*.json files
+	StaticKeysDir string `yaml:"static_keys_dir"`
+	// Retries is the number of times a failed request to a server is retried, within timeout (default 0)
+	Retries int `yaml:"retries"`
+	// RetryBackoff is the base delay, in milliseconds, between retries; it doubles at each retry and is jittered (default 100)
+	RetryBackoff int64 `yaml:"retry_backoff"`
+	// CircuitBreakerThreshold is the number of consecutive failures after which a server is skipped (default 0, disabled)
+	CircuitBreakerThreshold int `yaml:"circuit_breaker_threshold"`
+	// CircuitBreakerCooldown is how long, in seconds, a failing server is skipped before being probed again (default 60)
+	CircuitBreakerCooldown int64 `yaml:"circuit_breaker_cooldown"`
 }
 
+// QuorumOverride sets the verify quorum for hosts matching Host (see path.Match)
+type QuorumOverride struct {
+	Host   string
+	Quorum int
+}
+
+// PublicKeyEntry is a public_key entry: either a plain string (a key or the path of a key file)
+// or a map with the key and the signature algorithm, ID and validity period to use
+type PublicKeyEntry struct {
+	Key string
+	// Algorithm is one of the K_ALG_* constants, empty means the default for the key type
+	Algorithm string
+	// ID lets keys reference their signing key with key_id, instead of trying every public key
+	ID string
+	// NotBefore and NotAfter, when set, limit when the key is trusted
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+type PublicKeyList []PublicKeyEntry
+
+const (
+	K_ALG_RSA_PKCS1V15 = "rsa-pkcs1v15"
+	K_ALG_RSA_PSS      = "rsa-pss"
+	K_ALG_ED25519      = "ed25519"
+	K_ALG_ECDSA        = "ecdsa"
+	K_ALG_ECDSA_ASN1   = "ecdsa-asn1"
+	K_ALG_ECDSA_RAW    = "ecdsa-raw"
+)
+
 type rsaPublicKey struct {
 	*rsa.PublicKey
 }
 
+type rsaPSSPublicKey struct {
+	*rsa.PublicKey
+}
+
 type ed25519PublicKey struct {
 	ed25519.PublicKey
 }
 
+type ecdsaPublicKey struct {
+	*ecdsa.PublicKey
+	// ASN1 and Raw select the accepted signature encodings: DER or r||s
+	ASN1 bool
+	Raw  bool
+}
+
 // Verifier verifies signature against a public key.
 type Verifier interface {
 	// Sign returns raw signature for the given data. This method
@@ -66,6 +220,9 @@ type Verifier interface {
 
 var config Config
 
+// now returns the current time, tests replace it
+var now = time.Now
+
 func (a *StringArray) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var multi []string
 	err := unmarshal(&multi)
@@ -82,6 +239,53 @@ func (a *StringArray) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func (e *PublicKeyEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var key string
+	err := unmarshal(&key)
+	if err == nil {
+		*e = PublicKeyEntry{Key: key}
+		return nil
+	}
+	var entry struct {
+		Key       string
+		Algorithm string
+		ID        string
+		NotBefore time.Time `yaml:"not_before"`
+		NotAfter  time.Time `yaml:"not_after"`
+	}
+	err = unmarshal(&entry)
+	if err != nil {
+		return err
+	}
+	*e = PublicKeyEntry(entry)
+	return nil
+}
+
+func (a *PublicKeyList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var multi []PublicKeyEntry
+	err := unmarshal(&multi)
+	if err != nil {
+		var single PublicKeyEntry
+		err := unmarshal(&single)
+		if err != nil {
+			return err
+		}
+		*a = []PublicKeyEntry{single}
+	} else {
+		*a = multi
+	}
+	return nil
+}
+
+// newPublicKeyList returns the entries for keys, using the default algorithms
+func newPublicKeyList(keys ...string) PublicKeyList {
+	list := make(PublicKeyList, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, PublicKeyEntry{Key: key})
+	}
+	return list
+}
+
 // Query makes a request to Theo server at url sending auth token for the requested user
 func Query(user string) {
 	var ret int
@@ -89,50 +293,88 @@ func Query(user string) {
 	if ret > 0 {
 		os.Exit(ret)
 	}
+	keys, ret := queryKeys(user)
+	printAuthorizedKeys(keys)
+	os.Exit(ret)
+}
+
+// queryKeys returns the keys of user, from Theo server or the cache, which passed every check, and the exit code
+func queryKeys(user string) ([]Key, int) {
 	var keys []Key
-	_theoURL := config.URL
-	if *theoURL != "" {
-		_theoURL = *theoURL
-	}
+	_theoURLs := getTheoURLs()
 	_theoToken := config.Token
 	if *theoAccessToken != "" {
 		_theoToken = *theoAccessToken
 	}
-	body, ret := performQuery(user, _theoURL, _theoToken)
+	// Every request made for this login shares the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), getRequestTimeout())
+	defer cancel()
+	body, ret, server := performQuery(ctx, user, _theoURLs, _theoToken)
 	if *debug {
 		fmt.Fprintf(os.Stderr, "%s", body)
 	}
+	breakGlass := false
+	staticKeys := loadStaticKeys(user)
 	userCacheFile := getUserFilename(user)
 	if ret == 0 {
 		var err error
 		keys, err = loadKeysFromBody(body)
 		if err != nil {
-			os.Exit(9)
+			return nil, 9
 		}
 		ret = writeCacheFile(userCacheFile, keys)
+		keys = setKeysSource(keys, K_SOURCE_THEO)
+		for i := 0; i < len(keys); i++ {
+			keys[i].Server = server
+		}
 	} else {
 		if *debug {
 			fmt.Fprintf(os.Stderr, "Try to read cached keys for %s\n", user)
 		}
+		// 9 means no Theo server answered, see performFailoverRequest
+		unreachable := ret == 9
 		ret, keys = loadCacheFile(userCacheFile)
-		if ret > 0 {
+		keys = setKeysSource(keys, K_SOURCE_CACHE)
+		// A server refusing the request (e.g. 401, 403 or 404) must not be bypassed with break_glass keys
+		if keys == nil && unreachable {
 			fmt.Fprintf(os.Stderr, "Failed to read cached keys\n")
-			os.Exit(9)
+			keys = setKeysSource(getBreakGlassKeys(), K_SOURCE_BREAK_GLASS)
+			breakGlass = len(keys) > 0
 		}
 	}
-	if mustVerify() {
+	keys = mergeStaticKeys(keys, staticKeys)
+	keys = validateKeys(keys)
+	if mustVerify() || breakGlass {
 		var err error
 		publicKeys := getPublicKeys()
-		keys, err = verifyKeys(publicKeys, keys)
+		keys, err = verifyKeys(publicKeys, keys, user, loadHostname())
 		if err != nil {
-			os.Exit(9)
+			return nil, 9
 		}
 	}
-	if *sshFingerprint != "" {
+	keys = filterExpiredKeys(keys)
+	if config.CheckRevocations {
+		// Only the server which has just answered is asked, in the time left: when Theo is down, the cached list is used at once
+		revocationURLs := []string{}
+		if server != "" {
+			revocationURLs = append(revocationURLs, server)
+		}
+		keys = filterRevokedKeys(loadRevocationList(ctx, revocationURLs, _theoToken), keys)
+	}
+	keys = filterKeysByAccessPolicy(config.Access, user, keys)
+	keys = filterKeysBySchedule(config.Schedule, user, keys)
+	keys = filterKeysByKeyPolicy(config.KeyPolicy, user, keys)
+	keys = filterKeysBySourcePolicy(config.SourcePolicy, getConnection(), user, keys)
+	keys = filterKeysBySSHOptionsPolicy(keys)
+	if *sshKeyType != "" && *sshKey != "" {
+		keys = filterKeysByOfferedKey(*sshKeyType, *sshKey, *sshFingerprint, user, keys)
+	} else if *sshFingerprint != "" {
 		keys = filterKeysByFingerprint(*sshFingerprint, user, keys)
 	}
-	printAuthorizedKeys(keys)
-	os.Exit(ret)
+	if breakGlass {
+		alertBreakGlassKeys(user, keys)
+	}
+	return keys, ret
 }
 
 func mustVerify() bool {
@@ -145,11 +387,11 @@ func mustVerify() bool {
 	return _verify
 }
 
-func getPublicKeys() []string {
-	_publicKeys := make([]string, 0)
+func getPublicKeys() PublicKeyList {
+	_publicKeys := make(PublicKeyList, 0)
 
 	if *publicKeyPath != "" {
-		_publicKeys = append(_publicKeys, *publicKeyPath)
+		_publicKeys = newPublicKeyList(*publicKeyPath)
 	} else {
 		_publicKeys = config.PublicKey
 	}
@@ -161,15 +403,74 @@ func getPublicKeys() []string {
 }
 
 func filterKeysByFingerprint(fingerprint string, user string, keys []Key) []Key {
+	return filterKeysByMatch(user, keys, func(key Key) (bool, error) {
+		f, err := getKeyFingerprint(key.PublicKey)
+		if err != nil {
+			return false, err
+		}
+		return f == fingerprint, nil
+	})
+}
+
+// filterKeysByOfferedKey keeps the key offered to sshd (tokens %t and %k), comparing the key wire
+// encoding, so that keys written differently still match. When the offered key can not be parsed,
+// or no key matches, it falls back to the fingerprint (token %f).
+func filterKeysByOfferedKey(keyType string, keyBlob string, fingerprint string, user string, keys []Key) []Key {
+	offered, err := parseOfferedKey(keyType, keyBlob)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse offered key: %s\n", err)
+	} else {
+		offeredBytes := offered.Marshal()
+		retKeys := filterKeysByMatch(user, keys, func(key Key) (bool, error) {
+			pk, err := parseSSHPublicKey(key.PublicKey)
+			if err != nil {
+				return false, err
+			}
+			return bytes.Equal(pk.Marshal(), offeredBytes), nil
+		})
+		if len(retKeys) > 0 {
+			return retKeys
+		}
+	}
+	if fingerprint == "" {
+		return make([]Key, 0)
+	}
+	if *debug {
+		fmt.Fprintf(os.Stderr, "Offered key not matched, trying fingerprint %s\n", fingerprint)
+	}
+	return filterKeysByFingerprint(fingerprint, user, keys)
+}
+
+// parseOfferedKey parses the key offered to sshd, its type must match the type encoded in the blob
+func parseOfferedKey(keyType string, keyBlob string) (ssh.PublicKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(keyBlob)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return nil, err
+	}
+	if pk.Type() != keyType {
+		return nil, fmt.Errorf("key type %s does not match key blob type %s", keyType, pk.Type())
+	}
+	return pk, nil
+}
+
+// filterKeysByMatch returns the first key matching, logging the login
+func filterKeysByMatch(user string, keys []Key, match func(Key) (bool, error)) []Key {
 	retKeys := make([]Key, 0)
 	for i := 0; i < len(keys); i++ {
 		if keys[i].Account != "" {
-			sshpk := parseSSHPublicKey(keys[i].PublicKey)
-			f := ssh.FingerprintSHA256(sshpk)
-			if f == fingerprint {
+			matched, err := match(keys[i])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, err)
+				continue
+			}
+			if matched {
 				a, b := gsyslog.NewLogger(gsyslog.LOG_INFO, "AUTH", "theo-agent")
 				if b == nil {
-					a.Write([]byte(fmt.Sprintf("Account %s logged in as %s\n", keys[i].Account, user)))
+					a.Write([]byte(fmt.Sprintf("Account %s logged in as %s%s%s%s\n", keys[i].Account, user, getConnectionLog(getConnection()), getKeySource(keys[i]), getVerifiedBy(keys[i]))))
 				}
 				retKeys = append(retKeys, keys[i])
 				break
@@ -179,18 +480,34 @@ func filterKeysByFingerprint(fingerprint string, user string, keys []Key) []Key
 	return retKeys
 }
 
+func getVerifiedBy(key Key) string {
+	if len(key.VerifiedBy) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (key verified by %s)", strings.Join(key.VerifiedBy, ", "))
+}
+
 func printAuthorizedKeys(keys []Key) {
 	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
 	for i := 0; i < len(keys); i++ {
-		_, err := fmt.Printf(getAuthorizedKeysLine(keys[i]))
+		line, err := getAuthorizedKeysLine(keys[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, err)
+			continue
+		}
+		_, err = fmt.Print(line)
 		if err != nil {
 			break
 		}
 	}
 }
 
-func getAuthorizedKeysLine(key Key) string {
-	return fmt.Sprintf("%s%s\n", getSSHOptions(key.SSHOptions), key.PublicKey)
+func getAuthorizedKeysLine(key Key) (string, error) {
+	sshOptions, err := applyMandatorySSHOptions(getKeySSHOptions(key))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s\n", getSSHOptions(sshOptions), key.PublicKey), nil
 }
 
 func getSSHOptions(sshOptions string) string {
@@ -200,52 +517,55 @@ func getSSHOptions(sshOptions string) string {
 	return fmt.Sprintf("%s ", sshOptions)
 }
 
-func performQuery(user string, url string, token string) ([]byte, int) {
+func performQuery(ctx context.Context, user string, urls []string, token string) ([]byte, int, string) {
 
 	remotePath := fmt.Sprintf("authorized_keys/%s/%s", urlu.PathEscape(loadHostname()), urlu.PathEscape(user))
+
+	q := urlu.Values{}
+	if *sshFingerprint != "" {
+		q.Add("f", *sshFingerprint)
+	}
+	addConnectionParams(q, getConnection())
+	return performFailoverRequestContext(ctx, http.MethodGet, urls, token, remotePath, q, nil)
+}
+
+// performSingleRequest makes one attempt of the request, it also reports whether the failure is worth retrying
+func performSingleRequest(ctx context.Context, method string, url string, token string, remotePath string, q urlu.Values, body []byte) ([]byte, int, bool) {
 	remoteURL := fmt.Sprintf("%s/%s", url, remotePath)
 
-	req, err := http.NewRequest(http.MethodGet, remoteURL, nil)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, remoteURL, reqBody)
 	if err != nil {
 		if *debug {
 			fmt.Fprintf(os.Stderr, "Unable to get remote URL (%s): %s\n", remoteURL, err)
 		}
-		return nil, 8
+		return nil, 8, false
+	}
+	if len(q) > 0 {
+		req.URL.RawQuery = q.Encode()
 	}
-
-    q := req.URL.Query()
-    if *sshFingerprint != "" {
-        q.Add("f", *sshFingerprint)
-    }
-    if *sshConnection != "" {
-        connectionParts := strings.Split(*sshConnection, " ")
-        if len(connectionParts) == 4 {
-            q.Add("c", connectionParts[2])
-        }
-    }
-    req.URL.RawQuery = q.Encode()
 
 	if *debug {
 		fmt.Fprintf(os.Stderr, "Theo URL %s\n", remoteURL)
 	}
 
-	DefaultTimeout := int64(5000)
-	_timeout := DefaultTimeout
-	if config.Timeout > 0 {
-		_timeout = config.Timeout
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(_timeout)*time.Millisecond)
-	defer cancel()
 	req.Header.Set("User-Agent", common.AppVersion.UserAgent())
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		if *debug {
-			fmt.Fprintf(os.Stderr, "Unable to fetch authorized_keys (%s): %s\n", remoteURL, err)
+			fmt.Fprintf(os.Stderr, "Unable to fetch %s (%s): %s\n", remotePath, remoteURL, err)
 		}
-		return nil, 9
+		// Once the deadline is over, there is no time left to retry
+		return nil, 9, ctx.Err() == nil
 	}
 
 	defer resp.Body.Close()
@@ -253,16 +573,16 @@ func performQuery(user string, url string, token string) ([]byte, int) {
 		if *debug {
 			fmt.Fprintf(os.Stderr, "HTTP response error from %s: %d\n", remoteURL, resp.StatusCode)
 		}
-		return nil, 20
+		return nil, 20, isRetryableStatus(resp.StatusCode)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		if *debug {
 			fmt.Fprintf(os.Stderr, "Unable to parse HTTP response from %s: %s\n", remoteURL, err)
 		}
-		return nil, 20
+		return nil, 20, ctx.Err() == nil
 	}
-	return body, 0
+	return respBody, 0, false
 }
 
 func writeCacheFile(userCacheFile string, keys []Key) int {
@@ -277,7 +597,35 @@ func writeCacheFile(userCacheFile string, keys []Key) int {
 	return 0
 }
 
+// writeFileAtomic writes data to a temporary file in the same directory, then renames it to filename,
+// so that readers never see a partially written file
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(filename), fmt.Sprintf(".%s.*", path.Base(filename)))
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
 func getUserFilename(user string) string {
+	return fmt.Sprintf("%s/.%s.json", getCacheDir(), user)
+}
+
+func getCacheDir() string {
 	_cacheDirPath := config.Cachedir
 	if *cacheDirPath != "" {
 		_cacheDirPath = *cacheDirPath
@@ -288,9 +636,10 @@ func getUserFilename(user string) string {
 	if *debug {
 		fmt.Fprintf(os.Stderr, "cacheDir: %s\n", _cacheDirPath)
 	}
-	return fmt.Sprintf("%s/.%s.json", _cacheDirPath, user)
+	return _cacheDirPath
 }
 
+// loadCacheFile returns the cached keys, a missing or invalid cache file is not an error: it returns no keys
 func loadCacheFile(userCacheFile string) (int, []Key) {
 	dat, err := ioutil.ReadFile(userCacheFile)
 	if err != nil {
@@ -359,6 +708,12 @@ func parseConfig(configFile string) (Config, int) {
 		}
 		return config, 7
 	}
+	switch config.Access.Default {
+	case "", K_ACCESS_ALLOW, K_ACCESS_DENY:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid access default %q, must be %q or %q\n", config.Access.Default, K_ACCESS_ALLOW, K_ACCESS_DENY)
+		return config, 7
+	}
 	return config, 0
 }
 
@@ -371,46 +726,131 @@ func loadKeysFromBody(body []byte) ([]Key, error) {
 	return keys, nil
 }
 
-func verifyKeys(publicKey []string, keys []Key) ([]Key, error) {
+func verifyKeys(publicKeys PublicKeyList, keys []Key, user string, host string) ([]Key, error) {
+	trustedKeys := loadTrustedKeys(publicKeys)
+	if len(trustedKeys) == 0 {
+		return nil, errors.New("no usable public key to verify signatures")
+	}
+	quorum := getVerifyQuorum(host)
+	if quorum > len(trustedKeys) {
+		fmt.Fprintf(os.Stderr, "verify_quorum is %d, but only %d public keys are usable\n", quorum, len(trustedKeys))
+		return nil, fmt.Errorf("verify_quorum %d can not be reached", quorum)
+	}
 
 	retKeys := make([]Key, 0)
-	for i := 0; i < len(publicKey); i++ {
-		var perr error
-		var parser Verifier
-		publicKey := strings.Trim(publicKey[i], " ")
-		if publicKey == "" {
+	for x := 0; x < len(keys); x++ {
+		key := keys[x]
+		payload, err := signedPayload(key, user, host)
+		if err != nil {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Error from verification: %s\n", err)
+			}
 			continue
 		}
-		if strings.HasPrefix(publicKey, "-----BEGIN PUBLIC KEY-----") {
-			parser, perr = parsePublicKey([]byte(publicKey))
-			if perr != nil {
-				fmt.Fprintf(os.Stderr, "could not parse public key: %v\n", perr)
-				continue
+		key.VerifiedBy = verifySignatures(trustedKeys, payload, getSignatures(key.PublicKeySig, key.KeyID, key.Signatures))
+		if len(key.VerifiedBy) < quorum {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Error from verification: key #%d (%s) signed by %d trusted keys, %d required\n", x, key.Account, len(key.VerifiedBy), quorum)
 			}
-		} else {
-			parser, perr = loadPublicKey(publicKey)
-			if perr != nil {
-				fmt.Fprintf(os.Stderr, "could not load public key: %v\n", perr)
+			continue
+		}
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Key #%d (%s) verified by %s\n", x, key.Account, strings.Join(key.VerifiedBy, ", "))
+		}
+		retKeys = append(retKeys, key)
+	}
+	return retKeys, nil
+}
+
+// verifySignatures returns the trusted keys which made at least one of signatures of payload
+func verifySignatures(trustedKeys []trustedKey, payload []byte, signatures []keySignature) []string {
+	verifiedBy := make([]string, 0)
+	for i := 0; i < len(trustedKeys); i++ {
+		for _, signature := range signatures {
+			if signature.KeyID != "" && !trustedKeys[i].hasID(signature.KeyID) {
 				continue
 			}
+			if trustedKeys[i].Verifier.Verify(payload, signature.Signature) == nil {
+				verifiedBy = append(verifiedBy, trustedKeys[i].String())
+				break
+			}
 		}
+	}
+	return verifiedBy
+}
 
-		for x := 0; x < len(keys); x++ {
-			key := keys[x]
-			if parser != nil {
-				signature, _ := hex.DecodeString(key.PublicKeySig)
-				err := parser.Verify([]byte(key.PublicKey), signature)
-				if err != nil {
-					if *debug {
-						fmt.Fprintf(os.Stderr, "Error from verification: %s\n", err)
-					}
-					continue
-				}
-			}
-			retKeys = append(retKeys, key)
+// getSignatures returns the decoded signature, made by keyID, followed by every additional signature
+func getSignatures(signature string, keyID string, additional []KeySignature) []keySignature {
+	signatures := make([]keySignature, 0, len(additional)+1)
+	if signature != "" {
+		signatures = append(signatures, keySignature{keyID, decodeSignature(signature)})
+	}
+	for _, s := range additional {
+		signatures = append(signatures, keySignature{s.KeyID, decodeSignature(s.Signature)})
+	}
+	return signatures
+}
+
+// decodeSignature hex decodes signature, armored SSH signatures are returned as they are
+func decodeSignature(signature string) []byte {
+	if isSSHSignature(signature) {
+		return []byte(signature)
+	}
+	decoded, _ := hex.DecodeString(signature)
+	return decoded
+}
+
+// getVerifyQuorum returns how many trusted keys must vouch for a key on host
+func getVerifyQuorum(host string) int {
+	quorum := config.VerifyQuorum
+	for _, override := range config.VerifyQuorumHosts {
+		if matched, _ := path.Match(override.Host, host); matched {
+			quorum = override.Quorum
+			break
 		}
 	}
-	return retKeys, nil
+	if quorum < 1 {
+		return 1
+	}
+	return quorum
+}
+
+// signedPayload returns the message the server signed for key, according to its signature version.
+// user and host are the login and the hostname sent to the server.
+func signedPayload(key Key, user string, host string) ([]byte, error) {
+	// Only v3 signs the validity period: a v1 or v2 key could have it changed at will
+	if key.SignatureVersion < SignatureV3 && (key.NotBefore != "" || key.ExpiresAt != "") {
+		return nil, fmt.Errorf("not_before and expires_at require signature version %d", SignatureV3)
+	}
+	switch key.SignatureVersion {
+	case 0, SignatureV1:
+		if !config.AllowLegacySignatures {
+			return nil, errors.New("legacy signature (v1) not allowed, set allow_legacy_signatures to accept it")
+		}
+		return []byte(key.PublicKey), nil
+	case SignatureV2:
+		return ssh.Marshal(signatureV2Payload{
+			Magic:      signatureV2Magic,
+			PublicKey:  key.PublicKey,
+			SSHOptions: key.SSHOptions,
+			Account:    key.Account,
+			User:       user,
+			Host:       host,
+		}), nil
+	case SignatureV3:
+		return ssh.Marshal(signatureV3Payload{
+			Magic:      signatureV3Magic,
+			PublicKey:  key.PublicKey,
+			SSHOptions: key.SSHOptions,
+			Account:    key.Account,
+			User:       user,
+			Host:       host,
+			NotBefore:  key.NotBefore,
+			ExpiresAt:  key.ExpiresAt,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported signature version %d", key.SignatureVersion)
+	}
 }
 
 func loadPublicKey(path string) (Verifier, error) {
@@ -425,6 +865,10 @@ func loadPublicKey(path string) (Verifier, error) {
 }
 
 func parsePublicKey(pemBytes []byte) (Verifier, error) {
+	return parsePublicKeyWithAlgorithm(pemBytes, "")
+}
+
+func parsePublicKeyWithAlgorithm(pemBytes []byte, algorithm string) (Verifier, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, errors.New("public key file does not contains any key")
@@ -445,10 +889,10 @@ func parsePublicKey(pemBytes []byte) (Verifier, error) {
 		return nil, fmt.Errorf("rsa: unsupported key type %q", block.Type)
 	}
 
-	return newVerifierFromKey(rawkey)
+	return newVerifierFromKey(rawkey, algorithm)
 }
 
-func newVerifierFromKey(k interface{}) (Verifier, error) {
+func newVerifierFromKey(k interface{}, algorithm string) (Verifier, error) {
 	var sshKey Verifier
 
 	switch t := k.(type) {
@@ -456,13 +900,34 @@ func newVerifierFromKey(k interface{}) (Verifier, error) {
 		if *debug {
 			fmt.Fprintf(os.Stderr, "type is ed25519 %T\n", k)
 		}
-		sshKey = &ed25519PublicKey{t}
+		switch algorithm {
+		case "", K_ALG_ED25519:
+			sshKey = &ed25519PublicKey{t}
+		}
 		break
 	case *rsa.PublicKey:
 		if *debug {
 			fmt.Fprintf(os.Stderr, "type is rsa %T\n", k)
 		}
-		sshKey = &rsaPublicKey{t}
+		switch algorithm {
+		case "", K_ALG_RSA_PKCS1V15:
+			sshKey = &rsaPublicKey{t}
+		case K_ALG_RSA_PSS:
+			sshKey = &rsaPSSPublicKey{t}
+		}
+		break
+	case *ecdsa.PublicKey:
+		if *debug {
+			fmt.Fprintf(os.Stderr, "type is ecdsa %T\n", k)
+		}
+		switch algorithm {
+		case "", K_ALG_ECDSA:
+			sshKey = &ecdsaPublicKey{PublicKey: t, ASN1: true, Raw: true}
+		case K_ALG_ECDSA_ASN1:
+			sshKey = &ecdsaPublicKey{PublicKey: t, ASN1: true}
+		case K_ALG_ECDSA_RAW:
+			sshKey = &ecdsaPublicKey{PublicKey: t, Raw: true}
+		}
 		break
 	default:
 		if *debug {
@@ -470,6 +935,9 @@ func newVerifierFromKey(k interface{}) (Verifier, error) {
 		}
 		return nil, fmt.Errorf("unsupported key type %T", k)
 	}
+	if sshKey == nil {
+		return nil, fmt.Errorf("algorithm %q not supported by key type %T", algorithm, k)
+	}
 	return sshKey, nil
 }
 
@@ -481,6 +949,14 @@ func (r *rsaPublicKey) Verify(message []byte, signature []byte) error {
 	return rsa.VerifyPKCS1v15(r.PublicKey, crypto.SHA256, d, signature)
 }
 
+// Unsign verifies the message using a rsa-pss-sha256 signature, with any salt length
+func (r *rsaPSSPublicKey) Verify(message []byte, signature []byte) error {
+	h := sha256.New()
+	h.Write(message)
+	d := h.Sum(nil)
+	return rsa.VerifyPSS(r.PublicKey, crypto.SHA256, d, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+}
+
 // Unsign verifies the message using a ed25519 signature
 func (r *ed25519PublicKey) Verify(message []byte, signature []byte) error {
 	ok := ed25519.Verify(r.PublicKey, message, signature)
@@ -490,13 +966,61 @@ func (r *ed25519PublicKey) Verify(message []byte, signature []byte) error {
 	return errors.New("public key' signature not valid")
 }
 
-func parseSSHPublicKey(publicKey string) ssh.PublicKey {
+// Unsign verifies the message using an ecdsa signature, hashed with SHA-2 matching the curve size
+func (r *ecdsaPublicKey) Verify(message []byte, signature []byte) error {
+	var h hash.Hash
+	size := (r.Curve.Params().BitSize + 7) / 8
+	switch {
+	case size <= 32:
+		h = sha256.New()
+	case size <= 48:
+		h = sha512.New384()
+	default:
+		h = sha512.New()
+	}
+	h.Write(message)
+	d := h.Sum(nil)
+	if r.Raw && len(signature) == 2*size {
+		sigR := new(big.Int).SetBytes(signature[:size])
+		sigS := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(r.PublicKey, d, sigR, sigS) {
+			return nil
+		}
+	}
+	if r.ASN1 && ecdsa.VerifyASN1(r.PublicKey, d, signature) {
+		return nil
+	}
+	return errors.New("public key' signature not valid")
+}
+
+// getKeyFingerprint returns the SHA256 fingerprint of an authorized_keys public key
+func getKeyFingerprint(publicKey string) (string, error) {
+	pk, err := parseSSHPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(pk), nil
+}
+
+func parseSSHPublicKey(publicKey string) (ssh.PublicKey, error) {
 	pubKeyBytes := []byte(publicKey)
 
 	// Parse the key, other info ignored
 	pk, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return pk
+	if err := checkSSHKeyType(publicKey, pk); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// checkSSHKeyType ensures the key type written in publicKey matches the type encoded in the key blob
+func checkSSHKeyType(publicKey string, pk ssh.PublicKey) error {
+	fields := strings.Fields(publicKey)
+	if len(fields) > 0 && fields[0] != pk.Type() {
+		return fmt.Errorf("key type %s does not match key blob type %s", fields[0], pk.Type())
+	}
+	return nil
 }
@@ -3,8 +3,11 @@ package cmd
 import (
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -29,6 +32,13 @@ func TestParseConfig(t *testing.T) {
 	if len(config.PublicKey) != 1 {
 		t.Errorf("public_keys len %d expected 1\n", len(config.PublicKey))
 	}
+	config, ret = parseConfig("../test/config.5.yml")
+	if ret > 0 {
+		t.Errorf("parseConfig failed")
+	}
+	if config.VerifyQuorum != 2 || len(config.VerifyQuorumHosts) != 1 || config.VerifyQuorumHosts[0].Quorum != 1 {
+		t.Errorf("verify_quorum not parsed: %d %v\n", config.VerifyQuorum, config.VerifyQuorumHosts)
+	}
 }
 
 func TestVer(t *testing.T) {
@@ -60,7 +70,7 @@ func TestVerEmbedPublicKey(t *testing.T) {
 		fmt.Fprintf(os.Stderr, "Failed to read cached keys\n")
 		os.Exit(9)
 	}
-	parser, err := parsePublicKey([]byte(config.PublicKey[0]))
+	parser, err := parsePublicKey([]byte(config.PublicKey[0].Key))
 	signature, _ := hex.DecodeString(keys[0].PublicKeySig)
 	err = parser.Verify([]byte(keys[0].PublicKey), signature)
 	if err != nil {
@@ -79,7 +89,7 @@ func TestEdDSAPublicKey(t *testing.T) {
 		fmt.Fprintf(os.Stderr, "Failed to read cached keys\n")
 		t.Errorf("signature verify failed")
 	}
-	parser, err := parsePublicKey([]byte(config.PublicKey[0]))
+	parser, err := parsePublicKey([]byte(config.PublicKey[0].Key))
 	if err != nil {
 		t.Errorf("parser is nil")
 	}
@@ -90,7 +100,103 @@ func TestEdDSAPublicKey(t *testing.T) {
 	}
 }
 
+func TestECDSAPublicKey(t *testing.T) {
+	userCacheFile := "../test/test.signature-ecdsa.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	data, err := ioutil.ReadFile("../test/public-ecdsa.pem")
+	if err != nil {
+		t.Fatalf("Failed to read public key: %s", err)
+	}
+	expected := map[string][]bool{
+		"":               {true, true},
+		K_ALG_ECDSA:      {true, true},
+		K_ALG_ECDSA_ASN1: {true, false},
+		K_ALG_ECDSA_RAW:  {false, true},
+	}
+	for algorithm, results := range expected {
+		parser, err := parsePublicKeyWithAlgorithm(data, algorithm)
+		if err != nil {
+			t.Fatalf("parser is nil for algorithm %q: %s", algorithm, err)
+		}
+		for i := 0; i < len(keys); i++ {
+			signature, _ := hex.DecodeString(keys[i].PublicKeySig)
+			err = parser.Verify([]byte(keys[i].PublicKey), signature)
+			if (err == nil) != results[i] {
+				t.Errorf("algorithm %q: signature of %s verified %t, expected %t", algorithm, keys[i].Account, err == nil, results[i])
+			}
+		}
+	}
+	if _, err := parsePublicKeyWithAlgorithm(data, K_ALG_RSA_PSS); err == nil {
+		t.Errorf("rsa-pss must not be accepted for ecdsa keys")
+	}
+}
+
+func TestECDSA384PublicKey(t *testing.T) {
+	userCacheFile := "../test/test.signature-ecdsa384.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	parser, err := loadPublicKey("../test/public-ecdsa384.pem")
+	if err != nil {
+		t.Fatalf("loadPublicKey should return nil %s", err)
+	}
+	for i := 0; i < len(keys); i++ {
+		signature, _ := hex.DecodeString(keys[i].PublicKeySig)
+		err = parser.Verify([]byte(keys[i].PublicKey), signature)
+		if err != nil {
+			t.Errorf("signature verify failed for %s", keys[i].Account)
+		}
+	}
+}
+
+func TestRSAPSSPublicKey(t *testing.T) {
+	userCacheFile := "../test/test.signature-rsa-pss.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	data, err := ioutil.ReadFile("../test/public-rsa-pss.pem")
+	if err != nil {
+		t.Fatalf("Failed to read public key: %s", err)
+	}
+	signature, _ := hex.DecodeString(keys[0].PublicKeySig)
+	parser, _ := parsePublicKeyWithAlgorithm(data, K_ALG_RSA_PSS)
+	err = parser.Verify([]byte(keys[0].PublicKey), signature)
+	if err != nil {
+		t.Errorf("signature verify failed")
+	}
+	parser, _ = parsePublicKeyWithAlgorithm(data, K_ALG_RSA_PKCS1V15)
+	err = parser.Verify([]byte(keys[0].PublicKey), signature)
+	if err == nil {
+		t.Errorf("rsa-pss signature must not verify as pkcs1v15")
+	}
+}
+
+func TestParseConfigAlgorithms(t *testing.T) {
+	config, ret := parseConfig("../test/config.6.yml")
+	if ret > 0 {
+		t.Fatalf("parseConfig failed")
+	}
+	if len(config.PublicKey) != 3 {
+		t.Fatalf("public_keys len %d expected 3\n", len(config.PublicKey))
+	}
+	expected := []string{"", K_ALG_RSA_PSS, K_ALG_ECDSA_RAW}
+	for i := 0; i < len(expected); i++ {
+		if config.PublicKey[i].Algorithm != expected[i] {
+			t.Errorf("public_key[%d] algorithm %q expected %q", i, config.PublicKey[i].Algorithm, expected[i])
+		}
+	}
+	if !strings.HasPrefix(config.PublicKey[2].Key, "-----BEGIN PUBLIC KEY-----") {
+		t.Errorf("public_key[2] is not an inline key")
+	}
+}
+
 func TestSignatures(t *testing.T) {
+	defer allowLegacySignatures()()
 	userCacheFile := "../test/test.signatures.json"
 	ret, keys := loadCacheFile(userCacheFile)
 	if ret > 0 {
@@ -98,7 +204,7 @@ func TestSignatures(t *testing.T) {
 	}
 	validKeys := len(keys)
 	var err error
-	keys, err = verifyKeys([]string{"../test/public2.pem"}, keys)
+	keys, err = verifyKeys(newPublicKeyList("../test/public2.pem"), keys, "test", "test-host")
 	if err != nil {
 		t.Errorf("Failed to verify keys")
 	}
@@ -108,13 +214,14 @@ func TestSignatures(t *testing.T) {
 }
 
 func TestSignaturesWithBrokenSignature(t *testing.T) {
+	defer allowLegacySignatures()()
 	userCacheFile := "../test/test.signatures.json"
 	ret, keys := loadCacheFile(userCacheFile)
 	if ret > 0 {
 		t.Errorf("Failed to read cached keys")
 	}
 	var err error
-	keys, err = verifyKeys([]string{"../test/public.pem"}, keys)
+	keys, err = verifyKeys(newPublicKeyList("../test/public.pem"), keys, "test", "test-host")
 	if err != nil {
 		t.Errorf("Failed to verify keys")
 	}
@@ -124,13 +231,14 @@ func TestSignaturesWithBrokenSignature(t *testing.T) {
 }
 
 func TestVerifyKeysMultiplePublicKeys(t *testing.T) {
+	defer allowLegacySignatures()()
 	userCacheFile := "../test/test.signatures.json"
 	ret, keys := loadCacheFile(userCacheFile)
 	if ret > 0 {
 		t.Errorf("Failed to read cached keys")
 	}
 	var err error
-	keys, err = verifyKeys([]string{"../test/public.pem", "../test/public2.pem"}, keys)
+	keys, err = verifyKeys(newPublicKeyList("../test/public.pem", "../test/public2.pem"), keys, "test", "test-host")
 	if err != nil {
 		t.Errorf("Failed to verify keys")
 	}
@@ -139,7 +247,167 @@ func TestVerifyKeysMultiplePublicKeys(t *testing.T) {
 	}
 }
 
+func TestVerifyKeysDuplicatePublicKeys(t *testing.T) {
+	defer allowLegacySignatures()()
+	userCacheFile := "../test/test.signatures.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	publicKey, err := ioutil.ReadFile("../test/public2.pem")
+	if err != nil {
+		t.Fatalf("Failed to read public key: %s", err)
+	}
+	verified, err := verifyKeys(newPublicKeyList("../test/public2.pem", string(publicKey), "../test/public2.pem"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != len(keys) {
+		t.Fatalf("Keys len must be %d, got %d", len(keys), len(verified))
+	}
+	for i := 0; i < len(verified); i++ {
+		if verified[i].PublicKey != keys[i].PublicKey {
+			t.Errorf("Key #%d out of order", i)
+		}
+		if len(verified[i].VerifiedBy) != 1 || !strings.HasPrefix(verified[i].VerifiedBy[0], "../test/public2.pem ") {
+			t.Errorf("Key #%d verified by %q", i, verified[i].VerifiedBy)
+		}
+	}
+}
+
+func TestVerifyQuorum(t *testing.T) {
+	userCacheFile := "../test/test.signature-quorum.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	publicKeys := newPublicKeyList("../test/public-ed25519.pem", "../test/public-ed25519-2.pem")
+	verified, err := verifyKeys(publicKeys, keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 2 {
+		t.Errorf("Keys len must be %d, got %d", 2, len(verified))
+	}
+
+	config.VerifyQuorum = 2
+	defer func() {
+		config.VerifyQuorum = 0
+	}()
+	verified, err = verifyKeys(publicKeys, keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 1 {
+		t.Fatalf("Keys len must be %d, got %d", 1, len(verified))
+	}
+	if len(verified[0].VerifiedBy) != 2 {
+		t.Errorf("Key must be verified by %d keys, got %d", 2, len(verified[0].VerifiedBy))
+	}
+	_, err = verifyKeys(newPublicKeyList("../test/public-ed25519.pem", "../test/public-ed25519.pem"), keys, "test", "test-host")
+	if err == nil {
+		t.Errorf("Quorum must not be reached listing the same public key twice")
+	}
+}
+
+func TestVerifyQuorumHosts(t *testing.T) {
+	config.VerifyQuorumHosts = []QuorumOverride{{"dev-*", 1}, {"prod-*", 2}, {"*", 3}}
+	defer func() {
+		config.VerifyQuorumHosts = nil
+	}()
+	if q := getVerifyQuorum("prod-db1"); q != 2 {
+		t.Errorf("Quorum for prod-db1 must be %d, got %d", 2, q)
+	}
+	if q := getVerifyQuorum("dev-prod-1"); q != 1 {
+		t.Errorf("Quorum for dev-prod-1 must be %d, got %d", 1, q)
+	}
+	if q := getVerifyQuorum("test"); q != 3 {
+		t.Errorf("Quorum for test must be %d, got %d", 3, q)
+	}
+}
+
+func TestParseConfigKeyRotation(t *testing.T) {
+	config, ret := parseConfig("../test/config.7.yml")
+	if ret > 0 {
+		t.Fatalf("parseConfig failed")
+	}
+	if len(config.PublicKey) != 2 {
+		t.Fatalf("public_keys len %d expected 2\n", len(config.PublicKey))
+	}
+	if config.PublicKey[0].ID != "theo-2024" || !config.PublicKey[0].NotAfter.Equal(time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("public_key[0] not parsed: %+v", config.PublicKey[0])
+	}
+	if config.PublicKey[1].ID != "theo-2025" || !config.PublicKey[1].NotAfter.IsZero() {
+		t.Errorf("public_key[1] not parsed: %+v", config.PublicKey[1])
+	}
+}
+
+func TestVerifyKeysValidityWindow(t *testing.T) {
+	userCacheFile := "../test/test.signature-v2.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	publicKeys := PublicKeyList{
+		{Key: "../test/public-ed25519.pem", ID: "theo-2024", NotAfter: time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{Key: "../test/public-ed25519-2.pem", ID: "theo-2025", NotBefore: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	defer func() {
+		now = time.Now
+	}()
+
+	now = func() time.Time { return time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC) }
+	verified, err := verifyKeys(publicKeys, keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != len(keys) {
+		t.Errorf("Keys len must be %d, got %d", len(keys), len(verified))
+	}
+
+	now = func() time.Time { return time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC) }
+	verified, err = verifyKeys(publicKeys, keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 0 {
+		t.Errorf("Keys len must be %d, got %d", 0, len(verified))
+	}
+}
+
+func TestVerifyKeysKeyID(t *testing.T) {
+	userCacheFile := "../test/test.signature-v2.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	publicKeys := PublicKeyList{
+		{Key: "../test/public-ed25519-2.pem", ID: "theo-2025"},
+		{Key: "../test/public-ed25519.pem", ID: "theo-2024"},
+	}
+	keys[0].KeyID = "theo-2024"
+	keys[1].KeyID = "theo-2025"
+	verified, err := verifyKeys(publicKeys, keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 1 || verified[0].Account != keys[0].Account {
+		t.Fatalf("Only key #0 must be verified, got %d keys", len(verified))
+	}
+	if len(verified[0].VerifiedBy) != 1 || !strings.HasPrefix(verified[0].VerifiedBy[0], "theo-2024 ") {
+		t.Errorf("Key verified by %v", verified[0].VerifiedBy)
+	}
+
+	trustedKeys := loadTrustedKeys(publicKeys)
+	keys[1].KeyID = trustedKeys[1].Fingerprint
+	verified, _ = verifyKeys(publicKeys, keys, "test", "test-host")
+	if len(verified) != 2 {
+		t.Errorf("Keys len must be %d, got %d", 2, len(verified))
+	}
+}
+
 func TestBrokenKey(t *testing.T) {
+	defer allowLegacySignatures()()
 	userCacheFile := "../test/test.broken.json"
 	ret, keys := loadCacheFile(userCacheFile)
 	if ret > 0 {
@@ -147,7 +415,7 @@ func TestBrokenKey(t *testing.T) {
 		os.Exit(9)
 	}
 	var err error
-	keys, err = verifyKeys([]string{"../test/public.pem"}, keys)
+	keys, err = verifyKeys(newPublicKeyList("../test/public.pem"), keys, "test", "test-host")
 	if err != nil {
 		t.Errorf("Failed to verify keys")
 	}
@@ -156,6 +424,146 @@ func TestBrokenKey(t *testing.T) {
 	}
 }
 
+func TestLegacySignatureRejectedByDefault(t *testing.T) {
+	userCacheFile := "../test/test.signatures.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	var err error
+	keys, err = verifyKeys(newPublicKeyList("../test/public2.pem"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(keys) != 0 {
+		t.Errorf("Keys len must be %d, got %d", 0, len(keys))
+	}
+}
+
+func TestSignatureV2(t *testing.T) {
+	userCacheFile := "../test/test.signature-v2.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	validKeys := len(keys)
+	verified, err := verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != validKeys {
+		t.Errorf("Keys len must be %d, got %d", validKeys, len(verified))
+	}
+	verified, _ = verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "root", "test-host")
+	if len(verified) != 0 {
+		t.Errorf("Keys signed for another user must be rejected, got %d", len(verified))
+	}
+	verified, _ = verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "test", "other-host")
+	if len(verified) != 0 {
+		t.Errorf("Keys signed for another host must be rejected, got %d", len(verified))
+	}
+}
+
+func TestSignatureV2TamperedFields(t *testing.T) {
+	userCacheFile := "../test/test.signature-v2.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	keys[0].SSHOptions = "command=\"/bin/sh\""
+	keys[1].Account = "intruder@example.com"
+	verified, err := verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 0 {
+		t.Errorf("Keys len must be %d, got %d", 0, len(verified))
+	}
+}
+
+func TestSignatureV2ValidityPeriod(t *testing.T) {
+	userCacheFile := "../test/test.signature-v2.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	keys[0].ExpiresAt = "2099-01-01T00:00:00Z"
+	keys[1].NotBefore = "2020-01-01T00:00:00Z"
+	verified, err := verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != len(keys)-2 {
+		t.Errorf("v2 keys with a validity period must be rejected, got %d keys out of %d", len(verified), len(keys))
+	}
+}
+
+func TestFilterKeysByOfferedKey(t *testing.T) {
+	userCacheFile := "../test/test.broken.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	filtered := filterKeysByOfferedKey("ssh-ed25519", "AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA", "", "test", keys)
+	if len(filtered) != 1 || filtered[0].Account != "macno@example.com" {
+		t.Errorf("Only macno@example.com key must match, got %d keys", len(filtered))
+	}
+	filtered = filterKeysByOfferedKey("ssh-rsa", "AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA", "", "test", keys[len(keys)-1:])
+	if len(filtered) != 0 {
+		t.Errorf("Key type must match too")
+	}
+	filtered = filterKeysByOfferedKey("ssh-ed25519", "AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpU", "", "test", keys[len(keys)-1:])
+	if len(filtered) != 0 {
+		t.Errorf("Key blob prefix must not match, got %d keys", len(filtered))
+	}
+}
+
+func TestFilterKeysByOfferedKeyFallback(t *testing.T) {
+	userCacheFile := "../test/test.broken.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	fingerprint := "SHA256:d4RXf2B0bUGDaG0UufCX3+vUVxKnIvvIgTYC3bGGH14"
+	filtered := filterKeysByOfferedKey("ssh-ed25519", "not a key", fingerprint, "test", keys)
+	if len(filtered) != 1 || filtered[0].Account != "macno@example.com" {
+		t.Errorf("Unparsable offered key must fall back to fingerprint, got %d keys", len(filtered))
+	}
+	filtered = filterKeysByOfferedKey("ssh-ed25519", "AAAAC3NzaC1lZDI1NTE5AAAAIB8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA", fingerprint, "test", keys)
+	if len(filtered) != 1 || filtered[0].Account != "macno@example.com" {
+		t.Errorf("Offered key not matching must fall back to fingerprint, got %d keys", len(filtered))
+	}
+	filtered = filterKeysByOfferedKey("ssh-ed25519", "AAAAC3NzaC1lZDI1NTE5AAAAIB8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA", "SHA256:unknown", "test", keys)
+	if len(filtered) != 0 {
+		t.Errorf("Fallback fingerprint must match too, got %d keys", len(filtered))
+	}
+}
+
+func TestFingerprintBrokenKeys(t *testing.T) {
+	userCacheFile := "../test/test.broken.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	fingerprint := "SHA256:d4RXf2B0bUGDaG0UufCX3+vUVxKnIvvIgTYC3bGGH14"
+	filtered := filterKeysByFingerprint(fingerprint, "test", keys)
+	if len(filtered) != 1 || filtered[0].Account != "macno@example.com" {
+		t.Errorf("Only macno@example.com key must match, got %d keys", len(filtered))
+	}
+	for i := 0; i < len(keys)-1; i++ {
+		single := keys[i : i+1]
+		if filtered := filterKeysByFingerprint(fingerprint, "test", single); len(filtered) != 0 {
+			t.Errorf("Broken key %s must not match", keys[i].Account)
+		}
+		if _, err := getKeyFingerprint(keys[i].PublicKey); err == nil {
+			t.Errorf("Fingerprint of broken key %s must fail", keys[i].Account)
+		}
+		if validated := validateKeys(single); len(validated) != 0 {
+			t.Errorf("Broken key %s must be rejected", keys[i].Account)
+		}
+	}
+}
+
 func TestFingerprint(t *testing.T) {
 	userCacheFile := "../test/test.signatures.json"
 	ret, keys := loadCacheFile(userCacheFile)
@@ -175,12 +583,19 @@ func TestSSHOptions(t *testing.T) {
 		fmt.Fprintf(os.Stderr, "Failed to read cached keys\n")
 		os.Exit(9)
 	}
-	line := getAuthorizedKeysLine(keys[0])
+	line, _ := getAuthorizedKeysLine(keys[0])
 	if line != "from=\"192.168.2.1,10.10.0.0\" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA macno@jalapeno\n" {
 		t.Errorf("authorized_keys line[0] does not match")
 	}
-	line = getAuthorizedKeysLine(keys[1])
+	line, _ = getAuthorizedKeysLine(keys[1])
 	if line != "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA macno@jalapeno\n" {
 		t.Errorf("authorized_keys line[1] does not match")
 	}
 }
+
+func allowLegacySignatures() func() {
+	config.AllowLegacySignatures = true
+	return func() {
+		config.AllowLegacySignatures = false
+	}
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+)
+
+// getBreakGlassKeys returns the break_glass keys. They are always verified, so they are
+// ignored when no public key is set. As their signatures cover the login user and the
+// hostname, the same entry can not be shared by every host.
+func getBreakGlassKeys() []Key {
+	if len(config.BreakGlass) == 0 {
+		return nil
+	}
+	if *publicKeyPath == "" && len(config.PublicKey) == 0 {
+		fmt.Fprintf(os.Stderr, "Ignoring break_glass keys: no public key set to verify them\n")
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Using break_glass keys\n")
+	keys := make([]Key, len(config.BreakGlass))
+	copy(keys, config.BreakGlass)
+	return keys
+}
+
+// alertBreakGlassKeys logs an alert for every break_glass key handed to sshd
+func alertBreakGlassKeys(user string, keys []Key) {
+	a, b := gsyslog.NewLogger(gsyslog.LOG_ALERT, "AUTH", "theo-agent")
+	for i := 0; i < len(keys); i++ {
+		if keys[i].Source != K_SOURCE_BREAK_GLASS {
+			continue
+		}
+		message := fmt.Sprintf("BREAK-GLASS key of account %s offered to log in as %s%s: Theo server and cache unavailable", keys[i].Account, user, getConnectionLog(getConnection()))
+		fmt.Fprintf(os.Stderr, "%s\n", message)
+		if b == nil {
+			a.Write([]byte(message + "\n"))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakGlassKeys(t *testing.T) {
+	defer func(c Config, n func() time.Time) {
+		config = c
+		now = n
+	}(config, now)
+	var ret int
+	config, ret = parseConfig("../test/config.13.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	ret, cached := loadCacheFile("../test/test.missing.json")
+	if ret != 0 || cached != nil {
+		t.Errorf("Missing cache file must return no keys, got %d keys (ret %d)", len(cached), ret)
+	}
+
+	keys := getBreakGlassKeys()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 break_glass keys, got %d", len(keys))
+	}
+	keys = validateKeys(keys)
+	keys, err := verifyKeys(getPublicKeys(), keys, "test", "test-host")
+	if err != nil {
+		t.Fatalf("verifyKeys failed: %s", err)
+	}
+	if len(keys) != 1 || keys[0].Account != "emergency@example.com" {
+		t.Fatalf("Only the signed break_glass key must be kept, got %+v", keys)
+	}
+	now = func() time.Time { return time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC) }
+	if filtered := filterExpiredKeys(keys); len(filtered) != 1 {
+		t.Errorf("break_glass key must be valid before expires_at")
+	}
+	now = func() time.Time { return time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC) }
+	if filtered := filterExpiredKeys(keys); len(filtered) != 0 {
+		t.Errorf("break_glass key must expire at expires_at")
+	}
+
+	verified, _ := verifyKeys(getPublicKeys(), keys, "root", "test-host")
+	if len(verified) != 0 {
+		t.Errorf("break_glass key signed for another user must be rejected")
+	}
+
+	config.PublicKey = nil
+	if keys := getBreakGlassKeys(); keys != nil {
+		t.Errorf("break_glass keys must be ignored when they can not be verified")
+	}
+}
+
+func TestQueryBreakGlass(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(public)
+	key := Key{
+		PublicKey:        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA emergency",
+		SignatureVersion: SignatureV2,
+		Account:          "emergency@example.com",
+	}
+	config = Config{
+		Cachedir:   t.TempDir(),
+		PublicKey:  newPublicKeyList(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))),
+		BreakGlass: []Key{key},
+	}
+	payload, _ := signedPayload(key, "test", loadHostname())
+	config.BreakGlass[0].PublicKeySig = hex.EncodeToString(ed25519.Sign(private, payload))
+
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	config.URL = []string{server.URL}
+
+	var keys []Key
+	var ret int
+	alert := captureStderr(t, func() {
+		keys, ret = queryKeys("test")
+	})
+	if ret != 0 || len(keys) != 1 || keys[0].Source != K_SOURCE_BREAK_GLASS {
+		t.Fatalf("break_glass key expected when Theo server fails, got %+v (ret %d)", keys, ret)
+	}
+	if !strings.Contains(alert, "BREAK-GLASS key of account emergency@example.com") {
+		t.Errorf("break_glass key must be alerted, got %q", alert)
+	}
+
+	for _, status = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		if keys, ret = queryKeys("test"); ret != 0 || len(keys) != 0 {
+			t.Errorf("HTTP %d must not enable break_glass keys, got %d keys (ret %d)", status, len(keys), ret)
+		}
+	}
+
+	status = http.StatusServiceUnavailable
+	writeCacheFile(getUserFilename("test"), []Key{})
+	if keys, ret = queryKeys("test"); ret != 0 || len(keys) != 0 {
+		t.Errorf("Cached keys must be used instead of break_glass keys, got %d keys (ret %d)", len(keys), ret)
+	}
+}
+
+// captureStderr returns what f writes to stderr
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unable to create pipe: %s", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() {
+		os.Stderr = stderr
+	}()
+	f()
+	w.Close()
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	urlu "net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Connection is the ssh connection tuple, as expanded by sshd from the %C token:
+// client address, client port, server address, server port
+type Connection struct {
+	Client netip.AddrPort
+	Server netip.AddrPort
+}
+
+// parseConnection parses the value of -connection
+func parseConnection(s string) (*Connection, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("expected 4 fields, got %d", len(parts))
+	}
+	client, err := parseAddrPort(parts[0], parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("client: %s", err)
+	}
+	server, err := parseAddrPort(parts[2], parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("server: %s", err)
+	}
+	return &Connection{Client: client, Server: server}, nil
+}
+
+func parseAddrPort(addr string, port string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", port)
+	}
+	return netip.AddrPortFrom(ip.Unmap(), uint16(p)), nil
+}
+
+// getConnection returns the parsed -connection, nil when not set or invalid
+func getConnection() *Connection {
+	if *sshConnection == "" {
+		return nil
+	}
+	connection, err := parseConnection(*sshConnection)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring invalid connection %q: %s\n", *sshConnection, err)
+		return nil
+	}
+	return connection
+}
+
+// addConnectionParams adds the client (c) and server (s) addresses to the query sent to Theo server
+func addConnectionParams(q urlu.Values, connection *Connection) {
+	if connection == nil {
+		return
+	}
+	q.Add("c", connection.Client.Addr().String())
+	q.Add("s", connection.Server.Addr().String())
+}
+
+// getConnectionLog returns the connection details for the syslog audit line
+func getConnectionLog(connection *Connection) string {
+	if connection == nil {
+		return ""
+	}
+	return fmt.Sprintf(" from %s port %d to %s port %d", connection.Client.Addr(), connection.Client.Port(), connection.Server.Addr(), connection.Server.Port())
+}
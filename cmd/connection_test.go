@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	urlu "net/url"
+	"testing"
+)
+
+func TestParseConnection(t *testing.T) {
+	tests := []struct {
+		connection string
+		client     string
+		server     string
+		valid      bool
+	}{
+		{"192.0.2.10 51234 10.0.0.1 22", "192.0.2.10:51234", "10.0.0.1:22", true},
+		{"2001:db8::10 51234 2001:db8::1 22", "[2001:db8::10]:51234", "[2001:db8::1]:22", true},
+		{"::ffff:192.0.2.10 51234 ::ffff:10.0.0.1 22", "192.0.2.10:51234", "10.0.0.1:22", true},
+		{"192.0.2.10 51234 10.0.0.1", "", "", false},
+		{"192.0.2.10 51234 10.0.0.1 22 extra", "", "", false},
+		{"example.com 51234 10.0.0.1 22", "", "", false},
+		{"192.0.2.10 65536 10.0.0.1 22", "", "", false},
+		{"192.0.2.10 51234 10.0.0.1 ssh", "", "", false},
+	}
+	for _, test := range tests {
+		connection, err := parseConnection(test.connection)
+		if (err == nil) != test.valid {
+			t.Errorf("parseConnection(%q) valid should be %v, got %v", test.connection, test.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if connection.Client.String() != test.client || connection.Server.String() != test.server {
+			t.Errorf("parseConnection(%q) got client %s server %s", test.connection, connection.Client, connection.Server)
+		}
+	}
+}
+
+func TestAddConnectionParams(t *testing.T) {
+	connection, _ := parseConnection("2001:db8::10 51234 10.0.0.1 22")
+	q := urlu.Values{}
+	addConnectionParams(q, connection)
+	if q.Get("c") != "2001:db8::10" || q.Get("s") != "10.0.0.1" {
+		t.Errorf("Unexpected query %s", q.Encode())
+	}
+	if log := getConnectionLog(connection); log != " from 2001:db8::10 port 51234 to 10.0.0.1 port 22" {
+		t.Errorf("Unexpected connection log %q", log)
+	}
+	q = urlu.Values{}
+	addConnectionParams(q, nil)
+	if len(q) != 0 || getConnectionLog(nil) != "" {
+		t.Errorf("No connection must add nothing")
+	}
+}
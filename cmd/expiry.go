@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// sshExpiryTimeFormat is the expiry-time format understood by every OpenSSH version (local time)
+const sshExpiryTimeFormat = "20060102150405"
+
+// filterExpiredKeys drops the keys which are not valid yet, or not anymore
+func filterExpiredKeys(keys []Key) []Key {
+	t := now()
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		notBefore, expiresAt, err := getKeyValidity(keys[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, err)
+			continue
+		}
+		if !notBefore.IsZero() && t.Before(notBefore) {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Key #%d (%s) not valid before %s\n", i, keys[i].Account, keys[i].NotBefore)
+			}
+			continue
+		}
+		if !expiresAt.IsZero() && !t.Before(expiresAt) {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Key #%d (%s) expired at %s\n", i, keys[i].Account, keys[i].ExpiresAt)
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+// getKeyValidity parses not_before and expires_at, zero values mean not set
+func getKeyValidity(key Key) (notBefore time.Time, expiresAt time.Time, err error) {
+	if key.NotBefore != "" {
+		notBefore, err = time.Parse(time.RFC3339, key.NotBefore)
+		if err != nil {
+			return notBefore, expiresAt, fmt.Errorf("not_before: %s", err)
+		}
+	}
+	if key.ExpiresAt != "" {
+		expiresAt, err = time.Parse(time.RFC3339, key.ExpiresAt)
+		if err != nil {
+			return notBefore, expiresAt, fmt.Errorf("expires_at: %s", err)
+		}
+	}
+	return notBefore, expiresAt, nil
+}
+
+// getKeySSHOptions returns the key ssh options, with expiry-time set from expires_at
+// when expiry_time_option is on. An earlier expiry-time sent by the server is kept.
+func getKeySSHOptions(key Key) string {
+	if !config.ExpiryTimeOption || key.ExpiresAt == "" {
+		return key.SSHOptions
+	}
+	_, expiresAt, err := getKeyValidity(key)
+	if err != nil {
+		return key.SSHOptions
+	}
+	options, err := parseSSHOptions(key.SSHOptions)
+	if err != nil {
+		return key.SSHOptions
+	}
+	retOptions := make([]sshOption, 0, len(options)+1)
+	for _, option := range options {
+		if option.Name == "expiry-time" {
+			t, err := parseSSHTime(option.Value)
+			if err == nil && t.Before(expiresAt) {
+				return key.SSHOptions
+			}
+			continue
+		}
+		retOptions = append(retOptions, option)
+	}
+	retOptions = append(retOptions, sshOption{Name: "expiry-time", Value: expiresAt.Local().Format(sshExpiryTimeFormat), HasValue: true})
+	return formatSSHOptions(retOptions)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureV3Expiry(t *testing.T) {
+	userCacheFile := "../test/test.signature-v3.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	keys = validateKeys(keys)
+	verified, err := verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 4 {
+		t.Fatalf("Keys len must be %d, got %d", 4, len(verified))
+	}
+
+	defer func() {
+		now = time.Now
+	}()
+	now = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+	valid := filterExpiredKeys(verified)
+	if len(valid) != 2 || valid[0].Account != "contractor@example.com" || valid[1].Account != "permanent@example.com" {
+		t.Errorf("Only contractor@example.com and permanent@example.com keys must be valid, got %d keys", len(valid))
+	}
+
+	keys[1].ExpiresAt = "2099-01-01T00:00:00Z"
+	keys[2].NotBefore = ""
+	verified, _ = verifyKeys(newPublicKeyList("../test/public-ed25519.pem"), keys, "test", "test-host")
+	if len(verified) != 2 {
+		t.Errorf("Keys with tampered validity must be rejected, got %d keys", len(verified))
+	}
+}
+
+func TestExpiryTimeOption(t *testing.T) {
+	userCacheFile := "../test/test.signature-v3.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	defer func(c Config) {
+		config = c
+	}(config)
+
+	line, _ := getAuthorizedKeysLine(keys[0])
+	if !strings.HasPrefix(line, "no-pty ssh-ed25519 ") {
+		t.Errorf("expiry-time must not be added by default: %s", line)
+	}
+
+	config.ExpiryTimeOption = true
+	expiryTime := time.Date(2030, 6, 30, 18, 0, 0, 0, time.UTC).Local().Format("20060102150405")
+	line, _ = getAuthorizedKeysLine(keys[0])
+	if !strings.HasPrefix(line, "no-pty,expiry-time=\""+expiryTime+"\" ssh-ed25519 ") {
+		t.Errorf("authorized_keys line does not match: %s", line)
+	}
+	line, _ = getAuthorizedKeysLine(keys[3])
+	if !strings.HasPrefix(line, "ssh-ed25519 ") {
+		t.Errorf("expiry-time must not be added without expires_at: %s", line)
+	}
+
+	keys[0].SSHOptions = "expiry-time=\"20250101Z\""
+	if options := getKeySSHOptions(keys[0]); options != keys[0].SSHOptions {
+		t.Errorf("Earlier expiry-time must be kept, got %s", options)
+	}
+	keys[0].SSHOptions = "expiry-time=\"20350101Z\",no-pty"
+	if options := getKeySSHOptions(keys[0]); options != "no-pty,expiry-time=\""+expiryTime+"\"" {
+		t.Errorf("Later expiry-time must be replaced, got %s", options)
+	}
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+)
+
+const K_DEFAULT_CIRCUIT_BREAKER_COOLDOWN = int64(60)
+
+// serverHealth is the circuit breaker state of a Theo server
+type serverHealth struct {
+	// Failures counts the consecutive failures of the server
+	Failures int `json:"failures"`
+	// SkipUntil is when the server will be tried again, once Failures reached circuit_breaker_threshold
+	SkipUntil time.Time `json:"skip_until"`
+}
+
+func getHealthFilename() string {
+	return fmt.Sprintf("%s/health.json", getCacheDir())
+}
+
+func getHealthLockFilename() string {
+	return fmt.Sprintf("%s/.health.lock", getCacheDir())
+}
+
+func getCircuitBreakerCooldown() time.Duration {
+	cooldown := K_DEFAULT_CIRCUIT_BREAKER_COOLDOWN
+	if config.CircuitBreakerCooldown > 0 {
+		cooldown = config.CircuitBreakerCooldown
+	}
+	return time.Duration(cooldown) * time.Second
+}
+
+// loadHealth reads the circuit breaker state of every server, a missing or invalid file means they are all healthy
+func loadHealth() map[string]serverHealth {
+	health := make(map[string]serverHealth)
+	data, err := ioutil.ReadFile(getHealthFilename())
+	if err != nil {
+		return health
+	}
+	if err := json.Unmarshal(data, &health); err != nil {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Ignoring health file (%s): %s\n", getHealthFilename(), err)
+		}
+		return make(map[string]serverHealth)
+	}
+	return health
+}
+
+func saveHealth(health map[string]serverHealth) {
+	healthFile := getHealthFilename()
+	data, _ := json.Marshal(health)
+	if err := writeFileAtomic(healthFile, data, 0644); err != nil && *debug {
+		fmt.Fprintf(os.Stderr, "Unable to write cache file (%s): %s\n", healthFile, err)
+	}
+}
+
+// updateHealth runs update on the state of every server, then saves it if update returns true.
+// sshd runs many agents at once: the state is locked while it is updated.
+func updateHealth(update func(health map[string]serverHealth) bool) {
+	unlock, err := lockFile(getHealthLockFilename())
+	if err != nil {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Unable to lock health file (%s): %s\n", getHealthLockFilename(), err)
+		}
+		return
+	}
+	defer unlock()
+	health := loadHealth()
+	if update(health) {
+		saveHealth(health)
+	}
+}
+
+// allowServerRequest reports whether url may be tried: it is skipped after circuit_breaker_threshold
+// consecutive failures, until circuit_breaker_cooldown is over. Then a single agent probes it, while
+// the others keep skipping it for the time of a request.
+func allowServerRequest(url string) bool {
+	if config.CircuitBreakerThreshold <= 0 {
+		return true
+	}
+	// Most of the time servers are healthy, avoid locking then
+	if loadHealth()[url].Failures < config.CircuitBreakerThreshold {
+		return true
+	}
+	allow := true
+	updateHealth(func(health map[string]serverHealth) bool {
+		state := health[url]
+		if state.Failures < config.CircuitBreakerThreshold {
+			return false
+		}
+		if now().Before(state.SkipUntil) {
+			allow = false
+			return false
+		}
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Probing Theo server %s\n", url)
+		}
+		state.SkipUntil = now().Add(getRequestTimeout())
+		health[url] = state
+		return true
+	})
+	return allow
+}
+
+// recordServerHealth records whether url answered, skipping it once it failed circuit_breaker_threshold times in a row
+func recordServerHealth(url string, healthy bool) {
+	if config.CircuitBreakerThreshold <= 0 {
+		return
+	}
+	if healthy {
+		if _, ok := loadHealth()[url]; !ok {
+			return
+		}
+	}
+	updateHealth(func(health map[string]serverHealth) bool {
+		state, ok := health[url]
+		if healthy {
+			if !ok {
+				return false
+			}
+			if state.Failures >= config.CircuitBreakerThreshold {
+				logServerHealth(gsyslog.LOG_NOTICE, fmt.Sprintf("Theo server %s is back\n", url))
+			}
+			delete(health, url)
+			return true
+		}
+		state.Failures++
+		if state.Failures >= config.CircuitBreakerThreshold {
+			if state.Failures == config.CircuitBreakerThreshold {
+				logServerHealth(gsyslog.LOG_WARNING, fmt.Sprintf("Theo server %s failed %d times, skipping it for %s\n", url, state.Failures, getCircuitBreakerCooldown()))
+			}
+			state.SkipUntil = now().Add(getCircuitBreakerCooldown())
+		}
+		health[url] = state
+		return true
+	})
+}
+
+func logServerHealth(level gsyslog.Priority, message string) {
+	a, b := gsyslog.NewLogger(level, "AUTH", "theo-agent")
+	if b == nil {
+		a.Write([]byte(message))
+	}
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConfigCircuitBreaker(t *testing.T) {
+	cfg, ret := parseConfig("../test/config.16.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	if cfg.CircuitBreakerThreshold != 3 || cfg.CircuitBreakerCooldown != 30 {
+		t.Errorf("Unexpected circuit breaker threshold %d, cooldown %d", cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(c Config, n func() time.Time) {
+		config = c
+		now = n
+	}(config, now)
+	config.Cachedir = t.TempDir()
+	config.CircuitBreakerThreshold = 2
+	config.CircuitBreakerCooldown = 60
+	current := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	url := "https://theo.example.com"
+
+	recordServerHealth(url, false)
+	if !allowServerRequest(url) {
+		t.Fatalf("Server must be tried below the threshold")
+	}
+	recordServerHealth(url, false)
+	if allowServerRequest(url) {
+		t.Fatalf("Server must be skipped once the threshold is reached")
+	}
+
+	current = current.Add(61 * time.Second)
+	if !allowServerRequest(url) {
+		t.Fatalf("Server must be probed after the cooldown")
+	}
+	if allowServerRequest(url) {
+		t.Errorf("Only one agent must probe the server")
+	}
+	recordServerHealth(url, false)
+	current = current.Add(30 * time.Second)
+	if allowServerRequest(url) {
+		t.Errorf("Server failing the probe must be skipped for another cooldown")
+	}
+
+	current = current.Add(31 * time.Second)
+	if !allowServerRequest(url) {
+		t.Fatalf("Server must be probed after the cooldown")
+	}
+	recordServerHealth(url, true)
+	if _, ok := loadHealth()[url]; ok {
+		t.Errorf("Server answering the probe must be healthy again")
+	}
+	recordServerHealth(url, false)
+	if !allowServerRequest(url) {
+		t.Errorf("Failures must be counted again from 0")
+	}
+
+	config.CircuitBreakerThreshold = 0
+	for i := 0; i < 5; i++ {
+		recordServerHealth("https://other.example.com", false)
+	}
+	if !allowServerRequest("https://other.example.com") {
+		t.Errorf("Circuit breaker must be disabled by default")
+	}
+}
+
+func TestCircuitBreakerConcurrent(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Cachedir = t.TempDir()
+	config.CircuitBreakerThreshold = 1000
+	url := "https://theo.example.com"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recordServerHealth(url, false)
+		}()
+	}
+	wg.Wait()
+	if failures := loadHealth()[url].Failures; failures != 20 {
+		t.Errorf("Concurrent failures must all be counted, got %d", failures)
+	}
+}
+
+func TestPerformFailoverRequestCircuitBreaker(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Cachedir = t.TempDir()
+	config.CircuitBreakerThreshold = 2
+
+	requests := 0
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer notFound.Close()
+
+	for i := 0; i < 4; i++ {
+		if _, ret, _ := performFailoverRequest(http.MethodGet, []string{failing.URL}, "token", "authorized_keys/host/user", nil, nil); ret == 0 {
+			t.Fatalf("Request to a failing server must fail")
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Server known down must be skipped, got %d requests", requests)
+	}
+
+	for i := 0; i < 4; i++ {
+		performFailoverRequest(http.MethodGet, []string{notFound.URL}, "token", "authorized_keys/host/user", nil, nil)
+	}
+	if !allowServerRequest(notFound.URL) {
+		t.Errorf("Server answering 404 must not be considered down")
+	}
+
+	internalError := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer internalError.Close()
+	for i := 0; i < 2; i++ {
+		performFailoverRequest(http.MethodGet, []string{internalError.URL}, "token", "authorized_keys/host/user", nil, nil)
+	}
+	if allowServerRequest(internalError.URL) {
+		t.Errorf("Server answering 500 must be considered down")
+	}
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	urlu "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshHostKeysPattern matches the public host keys to request certificates for
+var sshHostKeysPattern = "/etc/ssh/ssh_host_*_key.pub"
+
+// K_HOST_CERTIFICATES_CRON is the crontab entry suggested at install to renew host certificates before they expire
+const K_HOST_CERTIFICATES_CRON = "17 * * * * root /usr/sbin/theo-agent -host-certificates"
+
+// HostCertificateRequest is sent to theo-node to get a host certificate for PublicKey
+type HostCertificateRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+// HostCertificateResponse is the object returned by theo-node, Certificate is in authorized_keys format
+type HostCertificateResponse struct {
+	Certificate string `json:"certificate"`
+}
+
+// RenewHostCertificates renews the host certificates which are missing or expiring,
+// then runs host_certificate_reload_command so that sshd uses them.
+// It must run periodically, see K_HOST_CERTIFICATES_CRON.
+func RenewHostCertificates() {
+	var ret int
+	config, ret = parseConfig("")
+	if ret > 0 {
+		os.Exit(ret)
+	}
+	_theoURLs := getTheoURLs()
+	_theoToken := config.Token
+	if *theoAccessToken != "" {
+		_theoToken = *theoAccessToken
+	}
+	_, renewed, ret := enrollHostCertificates(_theoURLs, _theoToken, false)
+	if renewed > 0 && len(config.HostCertificateReloadCommand) > 0 {
+		args := config.HostCertificateReloadCommand
+		if err := exec.Command(args[0], args[1:]...).Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to run host_certificate_reload_command (%s): %s\n", strings.Join(args, " "), err)
+			os.Exit(22)
+		}
+	}
+	os.Exit(ret)
+}
+
+// enrollHostCertificates requests a certificate for every host key, unless force is false and the
+// current one is still fresh. It returns the paths of the certificates to set as HostCertificate
+// and how many have been renewed.
+func enrollHostCertificates(urls []string, token string, force bool) ([]string, int, int) {
+	certificates := make([]string, 0)
+	hostKeys, _ := filepath.Glob(sshHostKeysPattern)
+	if len(hostKeys) == 0 {
+		fmt.Fprintf(os.Stderr, "No SSH host key found (%s)\n", sshHostKeysPattern)
+		return nil, 0, 23
+	}
+	renewed := 0
+	ret := 0
+	for _, hostKeyFile := range hostKeys {
+		certificateFile := getHostCertificateFilename(hostKeyFile)
+		ok, r := enrollHostCertificate(urls, token, hostKeyFile, certificateFile, force)
+		if r > 0 {
+			ret = r
+			continue
+		}
+		if ok {
+			renewed++
+		}
+		certificates = append(certificates, certificateFile)
+	}
+	return certificates, renewed, ret
+}
+
+// getHostCertificateFilename returns the path sshd expects for the certificate of a host key
+func getHostCertificateFilename(hostKeyFile string) string {
+	return fmt.Sprintf("%s-cert.pub", strings.TrimSuffix(hostKeyFile, ".pub"))
+}
+
+// enrollHostCertificate writes a new certificate for hostKeyFile, if needed, and reports whether it did
+func enrollHostCertificate(urls []string, token string, hostKeyFile string, certificateFile string, force bool) (bool, int) {
+	data, err := ioutil.ReadFile(hostKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read host key (%s): %s\n", hostKeyFile, err)
+		return false, 23
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse host key (%s): %s\n", hostKeyFile, err)
+		return false, 23
+	}
+	if !force && !mustRenewHostCertificate(certificateFile, hostKey) {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Host certificate %s is still valid\n", certificateFile)
+		}
+		return false, 0
+	}
+
+	body, _ := json.Marshal(HostCertificateRequest{PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))})
+	remotePath := fmt.Sprintf("host_certificates/%s", urlu.PathEscape(loadHostname()))
+	respBody, ret, _ := performFailoverRequest(http.MethodPost, urls, token, remotePath, nil, body)
+	if ret > 0 {
+		return false, ret
+	}
+	var response HostCertificateResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse json response : %s\n", err)
+		return false, 9
+	}
+	certificate, err := parseHostCertificate([]byte(response.Certificate), hostKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid host certificate for %s: %s\n", hostKeyFile, err)
+		return false, 9
+	}
+	err = writeFileAtomic(certificateFile, ssh.MarshalAuthorizedKey(certificate), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write host certificate (%s): %s\n", certificateFile, err)
+		return false, 21
+	}
+	a, b := gsyslog.NewLogger(gsyslog.LOG_INFO, "AUTH", "theo-agent")
+	if b == nil {
+		a.Write([]byte(fmt.Sprintf("Installed host certificate %s (serial %d, valid until %s)\n", certificateFile, certificate.Serial, getCertificateValidBefore(certificate))))
+	}
+	return true, 0
+}
+
+// parseHostCertificate checks data is a currently valid host certificate, correctly signed, for hostKey.
+// When -verify is on, the CA must also be one of the trusted public keys.
+func parseHostCertificate(data []byte, hostKey ssh.PublicKey) (*ssh.Certificate, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	certificate, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+	if certificate.CertType != ssh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+	if !bytes.Equal(certificate.Key.Marshal(), hostKey.Marshal()) {
+		return nil, errors.New("certificate is for another key")
+	}
+	principal := ""
+	if len(certificate.ValidPrincipals) > 0 {
+		principal = certificate.ValidPrincipals[0]
+	}
+	checker := ssh.CertChecker{Clock: now}
+	if err := checker.CheckCert(principal, certificate); err != nil {
+		return nil, err
+	}
+	if mustVerify() && !isTrustedHostCA(loadTrustedKeys(getPublicKeys()), certificate.SignatureKey) {
+		return nil, fmt.Errorf("certificate signed by untrusted CA %s", ssh.FingerprintSHA256(certificate.SignatureKey))
+	}
+	return certificate, nil
+}
+
+// isTrustedHostCA reports whether caKey is one of trustedKeys
+func isTrustedHostCA(trustedKeys []trustedKey, caKey ssh.PublicKey) bool {
+	for _, key := range trustedKeys {
+		if key.matchesSSHKey(caKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustRenewHostCertificate reports whether the certificate in certificateFile is missing, invalid,
+// or in the last third of its validity period
+func mustRenewHostCertificate(certificateFile string, hostKey ssh.PublicKey) bool {
+	data, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return true
+	}
+	certificate, err := parseHostCertificate(data, hostKey)
+	if err != nil {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Host certificate %s must be renewed: %s\n", certificateFile, err)
+		}
+		return true
+	}
+	if certificate.ValidBefore == ssh.CertTimeInfinity {
+		return false
+	}
+	validAfter := time.Unix(int64(certificate.ValidAfter), 0)
+	validBefore := time.Unix(int64(certificate.ValidBefore), 0)
+	renewAt := validBefore.Add(-validBefore.Sub(validAfter) / 3)
+	return !now().Before(renewAt)
+}
+
+func getCertificateValidBefore(certificate *ssh.Certificate) string {
+	if certificate.ValidBefore == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	return time.Unix(int64(certificate.ValidBefore), 0).UTC().Format(time.RFC3339)
+}
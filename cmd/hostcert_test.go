@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostCA(t *testing.T, certType uint32) (*httptest.Server, *int, ssh.PublicKey) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request HostCertificateRequest
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.PublicKey))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests++
+		certificate := &ssh.Certificate{
+			Key:             pk,
+			Serial:          uint64(requests),
+			CertType:        certType,
+			ValidPrincipals: []string{"test-host"},
+			ValidAfter:      uint64(now().Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(now().Add(2 * time.Hour).Unix()),
+		}
+		certificate.SignCert(rand.Reader, ca)
+		json.NewEncoder(w).Encode(HostCertificateResponse{Certificate: string(ssh.MarshalAuthorizedKey(certificate))})
+	}))
+	return server, &requests, ca.PublicKey()
+}
+
+func writeTestHostKey(t *testing.T, dir string) ssh.PublicKey {
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	pk, _ := ssh.NewPublicKey(public)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh_host_ed25519_key.pub"), ssh.MarshalAuthorizedKey(pk), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func TestEnrollHostCertificates(t *testing.T) {
+	defer func(pattern string, n func() time.Time) {
+		sshHostKeysPattern = pattern
+		now = n
+	}(sshHostKeysPattern, now)
+	dir := t.TempDir()
+	sshHostKeysPattern = filepath.Join(dir, "ssh_host_*_key.pub")
+	hostKey := writeTestHostKey(t, dir)
+
+	server, requests, _ := newTestHostCA(t, ssh.HostCert)
+	defer server.Close()
+
+	certificates, renewed, ret := enrollHostCertificates([]string{server.URL}, "token", true)
+	if ret > 0 || renewed != 1 || len(certificates) != 1 {
+		t.Fatalf("Expected 1 certificate, got %v (renewed %d, ret %d)", certificates, renewed, ret)
+	}
+	if certificates[0] != filepath.Join(dir, "ssh_host_ed25519_key-cert.pub") {
+		t.Errorf("Unexpected certificate path %s", certificates[0])
+	}
+	data, _ := ioutil.ReadFile(certificates[0])
+	if _, err := parseHostCertificate(data, hostKey); err != nil {
+		t.Errorf("Invalid certificate written: %s", err)
+	}
+
+	_, renewed, _ = enrollHostCertificates([]string{server.URL}, "token", false)
+	if renewed != 0 || *requests != 1 {
+		t.Errorf("Fresh certificate must not be renewed")
+	}
+
+	start := now()
+	now = func() time.Time { return start.Add(90 * time.Minute) }
+	_, renewed, _ = enrollHostCertificates([]string{server.URL}, "token", false)
+	if renewed != 1 || *requests != 2 {
+		t.Errorf("Certificate in the last third of its validity must be renewed")
+	}
+}
+
+func TestEnrollHostCertificatesRejectsUserCertificate(t *testing.T) {
+	defer func(pattern string) {
+		sshHostKeysPattern = pattern
+	}(sshHostKeysPattern)
+	dir := t.TempDir()
+	sshHostKeysPattern = filepath.Join(dir, "ssh_host_*_key.pub")
+	writeTestHostKey(t, dir)
+
+	server, _, _ := newTestHostCA(t, ssh.UserCert)
+	defer server.Close()
+
+	certificates, _, ret := enrollHostCertificates([]string{server.URL}, "token", true)
+	if ret == 0 || len(certificates) != 0 {
+		t.Errorf("User certificate must not be installed as host certificate")
+	}
+}
+
+func TestEnrollHostCertificatesVerifiesCA(t *testing.T) {
+	defer func(pattern string, c Config) {
+		sshHostKeysPattern = pattern
+		config = c
+	}(sshHostKeysPattern, config)
+	dir := t.TempDir()
+	sshHostKeysPattern = filepath.Join(dir, "ssh_host_*_key.pub")
+	writeTestHostKey(t, dir)
+
+	server, _, caKey := newTestHostCA(t, ssh.HostCert)
+	defer server.Close()
+	config.Verify = true
+
+	config.PublicKey = newPublicKeyList("../test/public-ed25519.pem")
+	if certificates, _, ret := enrollHostCertificates([]string{server.URL}, "token", true); ret == 0 || len(certificates) != 0 {
+		t.Errorf("Certificate signed by an untrusted CA must not be installed")
+	}
+
+	config.PublicKey = newPublicKeyList(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey))))
+	if certificates, _, ret := enrollHostCertificates([]string{server.URL}, "token", true); ret > 0 || len(certificates) != 1 {
+		t.Errorf("Certificate signed by a trusted SSH CA key must be installed, got ret %d", ret)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(caKey.(ssh.CryptoPublicKey).CryptoPublicKey())
+	config.PublicKey = newPublicKeyList(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	if certificates, _, ret := enrollHostCertificates([]string{server.URL}, "token", true); ret > 0 || len(certificates) != 1 {
+		t.Errorf("Certificate signed by a trusted PEM CA key must be installed, got ret %d", ret)
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -23,10 +24,10 @@ func getSshConfigs(user string, verify bool, version [2]int64) []SshConfig {
 	var commandOpts = ""
 	if version[0] < 6 || (version[0] == 6 && version[1] < 9) {
 		commandOpts = ""
-    } else if version[0] < 9 || (version[0] == 9 && version[1] < 4) {
-        commandOpts = "-fingerprint %f %u"
+	} else if version[0] < 9 || (version[0] == 9 && version[1] < 4) {
+		commandOpts = "-fingerprint %f -key-type %t -key %k %u"
 	} else {
-		commandOpts = "-fingerprint %f -connection %C %u"
+		commandOpts = "-fingerprint %f -key-type %t -key %k -connection %C %u"
 	}
 
 	var sshconfigs = []SshConfig{
@@ -35,6 +36,14 @@ func getSshConfigs(user string, verify bool, version [2]int64) []SshConfig {
 		SshConfig{"AuthorizedKeysCommandUser", user},
 	}
 
+	if *userCertificates {
+		sshconfigs = append(sshconfigs,
+			SshConfig{"TrustedUserCAKeys", *trustedUserCAKeysPath},
+			SshConfig{"AuthorizedPrincipalsCommand", fmt.Sprintf("/usr/sbin/theo-agent -principals %s", commandOpts)},
+			SshConfig{"AuthorizedPrincipalsCommandUser", user},
+		)
+	}
+
 	if !*passwordAuthentication {
 		sshconfigs = append(sshconfigs, SshConfig{"PasswordAuthentication", "no"})
 	}
@@ -53,8 +62,18 @@ func Install() {
 		fmt.Fprintf(os.Stderr, "Current OpenSSH version (%d.%d) does not support AuthorizedKeysCommand which is available from version 6.2\n", major, minor)
 		os.Exit(1)
 	}
+	if *userCertificates && (major < 6 || (major == 6 && minor < 9)) {
+		fmt.Fprintf(os.Stderr, "Current OpenSSH version (%d.%d) does not support AuthorizedPrincipalsCommand which is available from version 6.9\n", major, minor)
+		os.Exit(1)
+	}
 	prepareInstall()
 	checkConfig()
+	if *userCertificates {
+		installTrustedUserCAKeys()
+	}
+	if major < 9 || (major == 9 && minor < 4) {
+		fmt.Fprintf(os.Stderr, "Current OpenSSH version (%d.%d) does not pass the connection (%%C) to AuthorizedKeysCommand, available from version 9.4: source_policy rules will reject every key they apply to\n", major, minor)
+	}
 	version := [2]int64{major, minor}
 	if *cacheDirPath != "" {
 		_cacheDirPath = *cacheDirPath
@@ -63,12 +82,23 @@ func Install() {
 	}
 	mkdirs()
 	writeConfigYaml()
+	sshconfigs := getSshConfigs(*theoUser, *verify, version)
+	if *hostCertificates {
+		certificates, _, ret := enrollHostCertificates([]string{*theoURL}, *theoAccessToken, true)
+		if ret > 0 {
+			fmt.Fprintf(os.Stderr, "Unable to enroll host certificates from %s\n", *theoURL)
+			os.Exit(ret)
+		}
+		for _, certificate := range certificates {
+			sshconfigs = append(sshconfigs, SshConfig{"HostCertificate", certificate})
+		}
+		fmt.Fprintf(os.Stderr, "Host certificates must be renewed before they expire, add to /etc/cron.d/theo-agent:\n\n%s\n\n", K_HOST_CERTIFICATES_CRON)
+	}
 	if *editSshdConfig {
-		doEditSshdConfig(version)
+		doEditSshdConfig(sshconfigs)
 	} else {
 		fmt.Fprintf(os.Stderr, "You didn't specify -sshd-config so you have to edit manually /etc/ssh/sshd_config:\n\n")
 		i := 0
-		sshconfigs := getSshConfigs(*theoUser, *verify, version)
 		for i < len(sshconfigs) {
 			fmt.Fprintf(os.Stderr, "%s %s\n", sshconfigs[i].key, sshconfigs[i].value)
 			i++
@@ -159,7 +189,9 @@ func ensureDir(path string) {
 }
 
 func checkConfig() {
-	_, ret := performQuery("test", *theoURL, *theoAccessToken)
+	ctx, cancel := context.WithTimeout(context.Background(), getRequestTimeout())
+	defer cancel()
+	_, ret, _ := performQuery(ctx, "test", []string{*theoURL}, *theoAccessToken)
 	if ret > 0 {
 		panic(fmt.Sprintf("Check failed, unable to retrieve keys from %s", *theoURL))
 	}
@@ -201,7 +233,13 @@ func writeConfigYaml() {
 	}
 }
 
-func doEditSshdConfig(version [2]int64) bool {
+// multiValueSshdConfigs are the sshd_config keywords that can be set more than once,
+// their lines are only replaced when they already have the same value
+var multiValueSshdConfigs = map[string]bool{
+	"HostCertificate": true,
+}
+
+func doEditSshdConfig(sshconfigs []SshConfig) bool {
 	data, err := ioutil.ReadFile(*pathSshdConfig)
 	if err != nil {
 		if *debug {
@@ -221,14 +259,12 @@ func doEditSshdConfig(version [2]int64) bool {
 
 	lines := strings.Split(string(data), "\n")
 	i := 0
-	sshconfigs := getSshConfigs(*theoUser, *verify, version)
 	for i < len(lines) {
 		line := lines[i]
 		ii := 0
 
 		for ii < len(sshconfigs) {
-			p := strings.Index(line, sshconfigs[ii].key)
-			if p == 0 {
+			if isSshdConfigKey(line, sshconfigs[ii].key) && (!multiValueSshdConfigs[sshconfigs[ii].key] || getSshdConfigValue(line) == sshconfigs[ii].value) {
 				lines[i] = strings.Trim(fmt.Sprintf("%s %s", sshconfigs[ii].key, sshconfigs[ii].value), " ")
 				sshconfigs = remove(sshconfigs, ii)
 				break
@@ -261,6 +297,27 @@ func doEditSshdConfig(version [2]int64) bool {
 	return true
 }
 
+// isSshdConfigKey reports whether line sets key: keywords are case insensitive and
+// must be matched as a whole word, AuthorizedKeysCommand is not AuthorizedKeysCommandUser
+func isSshdConfigKey(line string, key string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	keyword := strings.SplitN(fields[0], "=", 2)[0]
+	return strings.EqualFold(keyword, key)
+}
+
+// getSshdConfigValue returns the value set by an sshd_config line
+func getSshdConfigValue(line string) string {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimLeft(line[i:], " \t=")
+}
+
 func remove(s []SshConfig, i int) []SshConfig {
 	s[len(s)-1], s[i] = s[i], s[len(s)-1]
 	return s[:len(s)-1]
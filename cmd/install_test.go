@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsSshdConfigKey(t *testing.T) {
+	tests := []struct {
+		line     string
+		key      string
+		expected bool
+	}{
+		{"AuthorizedKeysCommand /usr/sbin/theo-agent", "AuthorizedKeysCommand", true},
+		{"AuthorizedKeysCommandUser theo-agent", "AuthorizedKeysCommand", false},
+		{"authorizedkeyscommand /bin/true", "AuthorizedKeysCommand", true},
+		{"  UseDNS=no", "UseDNS", true},
+		{"#UseDNS no", "UseDNS", false},
+		{"", "UseDNS", false},
+	}
+	for _, test := range tests {
+		if isSshdConfigKey(test.line, test.key) != test.expected {
+			t.Errorf("isSshdConfigKey(%q, %q) should be %v", test.line, test.key, test.expected)
+		}
+	}
+}
+
+func TestDoEditSshdConfigHostCertificates(t *testing.T) {
+	defer func(p string) {
+		*pathSshdConfig = p
+	}(*pathSshdConfig)
+	*pathSshdConfig = filepath.Join(t.TempDir(), "sshd_config")
+	initial := "AuthorizedKeysCommandUser nobody\nHostCertificate /etc/ssh/other-cert.pub\nHostCertificate /etc/ssh/ssh_host_rsa_key-cert.pub\n"
+	ioutil.WriteFile(*pathSshdConfig, []byte(initial), 0644)
+
+	doEditSshdConfig([]SshConfig{
+		{"AuthorizedKeysCommand", "/usr/sbin/theo-agent"},
+		{"AuthorizedKeysCommandUser", "theo-agent"},
+		{"HostCertificate", "/etc/ssh/ssh_host_ed25519_key-cert.pub"},
+		{"HostCertificate", "/etc/ssh/ssh_host_rsa_key-cert.pub"},
+	})
+	data, _ := ioutil.ReadFile(*pathSshdConfig)
+	expected := []string{
+		"AuthorizedKeysCommandUser theo-agent",
+		"HostCertificate /etc/ssh/other-cert.pub",
+		"HostCertificate /etc/ssh/ssh_host_rsa_key-cert.pub",
+		"AuthorizedKeysCommand /usr/sbin/theo-agent",
+		"HostCertificate /etc/ssh/ssh_host_ed25519_key-cert.pub",
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("Missing line %q in:\n%s", line, data)
+		}
+	}
+	if strings.Count(string(data), "HostCertificate") != 3 || strings.Count(string(data), "AuthorizedKeysCommandUser") != 1 {
+		t.Errorf("Unexpected sshd_config:\n%s", data)
+	}
+}
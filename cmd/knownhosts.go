@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	urlu "net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KnownHost is a ssh_known_hosts entry: the host key, or the CA key signing host certificates, of Hosts
+type KnownHost struct {
+	// Hosts is a comma separated list of host name patterns
+	Hosts         string `json:"hosts"`
+	PublicKey     string `json:"public_key"`
+	CertAuthority bool   `json:"cert_authority"`
+}
+
+// KnownHostsList is the list of known hosts signed by the server
+type KnownHostsList struct {
+	// Serial increases with every new list, older lists are never accepted over newer ones
+	Serial     int64       `json:"serial"`
+	KnownHosts []KnownHost `json:"known_hosts"`
+}
+
+// SignedKnownHosts is the object returned by theo-node. KnownHosts holds the JSON encoded
+// KnownHostsList as a string, so that the signed bytes can be verified as they are.
+// A JSON encoded []KnownHost is accepted too, with serial 0.
+type SignedKnownHosts struct {
+	KnownHosts string         `json:"known_hosts"`
+	Signature  string         `json:"signature"`
+	KeyID      string         `json:"key_id,omitempty"`
+	Signatures []KeySignature `json:"signatures,omitempty"`
+}
+
+// knownHostsPayload is the wire encoded message signed by the server
+type knownHostsPayload struct {
+	Magic      string
+	KnownHosts string
+}
+
+const knownHostsMagic = "theo-agent-known-hosts-v1"
+
+const knownHostsHeader = "# Managed by theo-agent, do not edit: changes will be overwritten\n"
+
+// KnownHosts fetches the known hosts from Theo server, falling back to the cached ones,
+// and writes them to -known-hosts-path
+func KnownHosts() {
+	var ret int
+	config, ret = parseConfig("")
+	if ret > 0 {
+		os.Exit(ret)
+	}
+	_theoURLs := getTheoURLs()
+	_theoToken := config.Token
+	if *theoAccessToken != "" {
+		_theoToken = *theoAccessToken
+	}
+	knownHosts, ret := loadKnownHosts(_theoURLs, _theoToken)
+	if ret > 0 {
+		os.Exit(ret)
+	}
+	err := writeFileAtomic(*knownHostsPath, []byte(formatKnownHosts(knownHosts)), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write known hosts file (%s): %s\n", *knownHostsPath, err)
+		os.Exit(21)
+	}
+	os.Exit(0)
+}
+
+func getKnownHostsFilename() string {
+	return fmt.Sprintf("%s/known_hosts.json", getCacheDir())
+}
+
+// loadKnownHosts fetches the known hosts from Theo server, caching them, or reads the cached ones.
+// Known hosts with a lower serial than the cached ones are ignored, so that old lists can not be replayed.
+func loadKnownHosts(urls []string, token string) ([]KnownHost, int) {
+	knownHostsFile := getKnownHostsFilename()
+	var cached *KnownHostsList
+	data, err := ioutil.ReadFile(knownHostsFile)
+	if err == nil {
+		cached, err = parseKnownHosts(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring cached known hosts (%s): %s\n", knownHostsFile, err)
+		}
+	} else if *debug {
+		fmt.Fprintf(os.Stderr, "Unable to read cached known hosts (%s): %s\n", knownHostsFile, err)
+	}
+
+	remotePath := fmt.Sprintf("known_hosts/%s", urlu.PathEscape(loadHostname()))
+	body, ret, server := performFailoverRequest(http.MethodGet, urls, token, remotePath, nil, nil)
+	if ret == 0 {
+		fetched, err := parseKnownHosts(body)
+		if err == nil && cached != nil {
+			err = checkSerial(fetched.Serial, cached.Serial)
+		}
+		if err == nil {
+			if err := writeFileAtomic(knownHostsFile, body, 0644); err != nil && *debug {
+				fmt.Fprintf(os.Stderr, "Unable to write cache file (%s): %s\n", knownHostsFile, err)
+			}
+			return fetched.KnownHosts, 0
+		}
+		fmt.Fprintf(os.Stderr, "Ignoring known hosts from %s: %s\n", server, err)
+	}
+	if cached == nil {
+		fmt.Fprintf(os.Stderr, "Failed to read cached known hosts\n")
+		return nil, 9
+	}
+	if *debug {
+		fmt.Fprintf(os.Stderr, "Using cached known hosts\n")
+	}
+	return cached.KnownHosts, 0
+}
+
+// parseKnownHosts decodes a SignedKnownHosts, verifying its signatures when -verify is on.
+// A single invalid entry rejects the whole list, which is only ever replaced as a whole.
+func parseKnownHosts(data []byte) (*KnownHostsList, error) {
+	var signed SignedKnownHosts
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+	if mustVerify() {
+		if err := verifyKnownHosts(signed); err != nil {
+			return nil, err
+		}
+	}
+	var list KnownHostsList
+	if strings.HasPrefix(strings.TrimSpace(signed.KnownHosts), "[") {
+		if err := json.Unmarshal([]byte(signed.KnownHosts), &list.KnownHosts); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal([]byte(signed.KnownHosts), &list); err != nil {
+		return nil, err
+	}
+	for i, knownHost := range list.KnownHosts {
+		if err := validateKnownHost(knownHost); err != nil {
+			return nil, fmt.Errorf("known host #%d: %s", i, err)
+		}
+	}
+	return &list, nil
+}
+
+// verifyKnownHosts checks the known hosts have been signed by verify_quorum trusted keys
+func verifyKnownHosts(signed SignedKnownHosts) error {
+	trustedKeys := loadTrustedKeys(getPublicKeys())
+	payload := ssh.Marshal(knownHostsPayload{Magic: knownHostsMagic, KnownHosts: signed.KnownHosts})
+	verifiedBy := verifySignatures(trustedKeys, payload, getSignatures(signed.Signature, signed.KeyID, signed.Signatures))
+	quorum := getVerifyQuorum(loadHostname())
+	if len(verifiedBy) < quorum {
+		return fmt.Errorf("known hosts signed by %d trusted keys, %d required", len(verifiedBy), quorum)
+	}
+	if *debug {
+		fmt.Fprintf(os.Stderr, "Known hosts verified by %s\n", strings.Join(verifiedBy, ", "))
+	}
+	return nil
+}
+
+func validateKnownHost(knownHost KnownHost) error {
+	if knownHost.Hosts == "" {
+		return errors.New("empty hosts")
+	}
+	for i := 0; i < len(knownHost.Hosts); i++ {
+		c := knownHost.Hosts[i]
+		if c <= ' ' || c == 0x7f || c == '#' {
+			return fmt.Errorf("hosts contains invalid character %q at offset %d", c, i)
+		}
+	}
+	if strings.HasPrefix(knownHost.Hosts, "@") {
+		return errors.New("hosts must not start with @")
+	}
+	if i := indexControlChar(knownHost.PublicKey); i >= 0 {
+		return fmt.Errorf("public_key contains control character %q at offset %d", knownHost.PublicKey[i], i)
+	}
+	pk, _, options, rest, err := ssh.ParseAuthorizedKey([]byte(knownHost.PublicKey))
+	if err != nil {
+		return fmt.Errorf("public_key: %s", err)
+	}
+	if len(options) > 0 || len(rest) > 0 {
+		return errors.New("public_key must contain a single key without options")
+	}
+	if err := checkSSHKeyType(knownHost.PublicKey, pk); err != nil {
+		return fmt.Errorf("public_key: %s", err)
+	}
+	return nil
+}
+
+// formatKnownHosts returns the ssh_known_hosts file content, see sshd(8)
+func formatKnownHosts(knownHosts []KnownHost) string {
+	var sb strings.Builder
+	sb.WriteString(knownHostsHeader)
+	for _, knownHost := range knownHosts {
+		if knownHost.CertAuthority {
+			sb.WriteString("@cert-authority ")
+		}
+		sb.WriteString(fmt.Sprintf("%s %s\n", knownHost.Hosts, strings.TrimSpace(knownHost.PublicKey)))
+	}
+	return sb.String()
+}
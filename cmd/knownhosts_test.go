@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseKnownHosts(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Verify = true
+	config.PublicKey = newPublicKeyList("../test/public-ed25519.pem")
+
+	data, err := ioutil.ReadFile("../test/test.known_hosts.json")
+	if err != nil {
+		t.Fatalf("Failed to read known hosts: %s", err)
+	}
+	list, err := parseKnownHosts(data)
+	if err != nil {
+		t.Fatalf("parseKnownHosts failed: %s", err)
+	}
+	knownHosts := list.KnownHosts
+	expected := knownHostsHeader +
+		"@cert-authority *.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO theo-host-ca\n" +
+		"legacy.example.org,10.0.0.1 ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHg4kZmvbz02n35orv1l6PMujtFgRUkk0zZdLcq65Xy3Y2kzj3lEvmeOf6mWse4iYPbxi6Q6wDr8ZKKiBgq2bEc=\n"
+	if formatted := formatKnownHosts(knownHosts); formatted != expected {
+		t.Errorf("Unexpected known hosts:\n%s", formatted)
+	}
+
+	tampered := strings.Replace(string(data), "*.example.com", "*", 1)
+	if _, err := parseKnownHosts([]byte(tampered)); err == nil {
+		t.Errorf("Tampered known hosts must be rejected")
+	}
+
+	config.PublicKey = newPublicKeyList("../test/public-ed25519-2.pem")
+	if _, err := parseKnownHosts(data); err == nil {
+		t.Errorf("Known hosts signed by an untrusted key must be rejected")
+	}
+}
+
+func TestValidateKnownHost(t *testing.T) {
+	publicKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO"
+	tests := []struct {
+		knownHost KnownHost
+		valid     bool
+	}{
+		{KnownHost{Hosts: "host.example.com", PublicKey: publicKey}, true},
+		{KnownHost{Hosts: "", PublicKey: publicKey}, false},
+		{KnownHost{Hosts: "a b", PublicKey: publicKey}, false},
+		{KnownHost{Hosts: "@revoked", PublicKey: publicKey}, false},
+		{KnownHost{Hosts: "host\n*", PublicKey: publicKey}, false},
+		{KnownHost{Hosts: "host", PublicKey: publicKey + "\n* " + publicKey}, false},
+		{KnownHost{Hosts: "host", PublicKey: "no-pty " + publicKey}, false},
+		{KnownHost{Hosts: "host", PublicKey: "ssh-ed25519"}, false},
+	}
+	for _, test := range tests {
+		err := validateKnownHost(test.knownHost)
+		if (err == nil) != test.valid {
+			t.Errorf("validateKnownHost(%+v) valid should be %v, got %v", test.knownHost, test.valid, err)
+		}
+	}
+}
+
+func TestLoadKnownHostsFallback(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Cachedir = t.TempDir()
+
+	data, _ := ioutil.ReadFile("../test/test.known_hosts.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/known_hosts/") || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	knownHosts, ret := loadKnownHosts([]string{server.URL}, "token")
+	if ret > 0 || len(knownHosts) != 2 {
+		t.Fatalf("Expected 2 known hosts, got %d (ret %d)", len(knownHosts), ret)
+	}
+
+	server.Close()
+	knownHosts, ret = loadKnownHosts([]string{server.URL}, "token")
+	if ret > 0 || len(knownHosts) != 2 {
+		t.Errorf("Expected 2 cached known hosts, got %d (ret %d)", len(knownHosts), ret)
+	}
+}
+
+func TestLoadKnownHostsRollback(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Cachedir = t.TempDir()
+
+	newList := `{"known_hosts": "{\"serial\":2,\"known_hosts\":[{\"hosts\":\"new.example.com\",\"public_key\":\"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO\"}]}"}`
+	oldList := `{"known_hosts": "{\"serial\":1,\"known_hosts\":[{\"hosts\":\"old.example.com\",\"public_key\":\"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO\"}]}"}`
+	legacyList, _ := ioutil.ReadFile("../test/test.known_hosts.json")
+	served := newList
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(served))
+	}))
+	defer server.Close()
+
+	knownHosts, ret := loadKnownHosts([]string{server.URL}, "token")
+	if ret > 0 || len(knownHosts) != 1 || knownHosts[0].Hosts != "new.example.com" {
+		t.Fatalf("Known hosts serial 2 expected, got %+v (ret %d)", knownHosts, ret)
+	}
+	for _, served = range []string{oldList, string(legacyList)} {
+		knownHosts, ret = loadKnownHosts([]string{server.URL}, "token")
+		if ret > 0 || len(knownHosts) != 1 || knownHosts[0].Hosts != "new.example.com" {
+			t.Errorf("Older known hosts must not replace the cached ones, got %+v (ret %d)", knownHosts, ret)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+)
+
+// restrictiveSSHOptions maps the options disabling a feature to the option enabling it
+var restrictiveSSHOptions = map[string]string{
+	"no-agent-forwarding": "agent-forwarding",
+	"no-port-forwarding":  "port-forwarding",
+	"no-pty":              "pty",
+	"no-user-rc":          "user-rc",
+	"no-x11-forwarding":   "x11-forwarding",
+}
+
+// singleValueSSHOptions are the options that can be set only once per key
+var singleValueSSHOptions = map[string]bool{
+	"command":     true,
+	"expiry-time": true,
+	"from":        true,
+	"principals":  true,
+	"tunnel":      true,
+}
+
+// getMandatorySSHOptions parses mandatory_ssh_options
+func getMandatorySSHOptions() ([]sshOption, error) {
+	options, err := parseSSHOptions(config.MandatorySSHOptions)
+	if err != nil {
+		return nil, fmt.Errorf("mandatory_ssh_options: %s", err)
+	}
+	return options, nil
+}
+
+// mergeSSHOptions adds mandatory to options, dropping the options re-enabling what mandatory
+// disables. It fails when a single value option, like from or command, is set to another value.
+func mergeSSHOptions(options []sshOption, mandatory []sshOption) ([]sshOption, error) {
+	disabled := make(map[string]bool)
+	for _, option := range mandatory {
+		if option.Name == "restrict" {
+			for _, permissive := range restrictiveSSHOptions {
+				disabled[permissive] = true
+			}
+		}
+		if permissive, ok := restrictiveSSHOptions[option.Name]; ok {
+			disabled[permissive] = true
+		}
+	}
+	merged := make([]sshOption, 0, len(options)+len(mandatory))
+	for _, option := range options {
+		if !disabled[option.Name] {
+			merged = append(merged, option)
+		}
+	}
+	for _, option := range mandatory {
+		found := false
+		for _, existing := range merged {
+			if existing.Name != option.Name {
+				continue
+			}
+			if existing.Value == option.Value {
+				found = true
+				break
+			}
+			if singleValueSSHOptions[option.Name] {
+				return nil, fmt.Errorf("option %s=%q conflicts with mandatory %s=%q", existing.Name, existing.Value, option.Name, option.Value)
+			}
+		}
+		if !found {
+			merged = append(merged, option)
+		}
+	}
+	return merged, nil
+}
+
+// filterKeysBySSHOptionsPolicy drops the keys with forbidden_ssh_options, or whose options
+// conflict with mandatory_ssh_options
+func filterKeysBySSHOptionsPolicy(keys []Key) []Key {
+	if config.MandatorySSHOptions == "" && len(config.ForbiddenSSHOptions) == 0 {
+		return keys
+	}
+	mandatory, err := getMandatorySSHOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rejected every key: %s\n", err)
+		return make([]Key, 0)
+	}
+	forbidden := make(map[string]bool, len(config.ForbiddenSSHOptions))
+	for _, name := range config.ForbiddenSSHOptions {
+		forbidden[strings.ToLower(name)] = true
+	}
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		reason := ""
+		options, err := parseSSHOptions(keys[i].SSHOptions)
+		if err != nil {
+			reason = fmt.Sprintf("ssh_options: %s", err)
+		} else {
+			for _, option := range options {
+				if forbidden[option.Name] {
+					reason = fmt.Sprintf("option %s is forbidden", option.Name)
+					break
+				}
+			}
+			if reason == "" {
+				if _, err := mergeSSHOptions(options, mandatory); err != nil {
+					reason = err.Error()
+				}
+			}
+		}
+		if reason != "" {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, reason)
+			a, b := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "AUTH", "theo-agent")
+			if b == nil {
+				a.Write([]byte(fmt.Sprintf("Dropped key of account %s: %s\n", keys[i].Account, reason)))
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+// applyMandatorySSHOptions returns sshOptions with mandatory_ssh_options merged in
+func applyMandatorySSHOptions(sshOptions string) (string, error) {
+	if config.MandatorySSHOptions == "" {
+		return sshOptions, nil
+	}
+	mandatory, err := getMandatorySSHOptions()
+	if err != nil {
+		return "", err
+	}
+	options, err := parseSSHOptions(sshOptions)
+	if err != nil {
+		return "", err
+	}
+	merged, err := mergeSSHOptions(options, mandatory)
+	if err != nil {
+		return "", err
+	}
+	return formatSSHOptions(merged), nil
+}
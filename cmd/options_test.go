@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestMandatorySSHOptions(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	var ret int
+	config, ret = parseConfig("../test/config.9.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	publicKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA"
+	keys := []Key{
+		{Account: "plain", PublicKey: publicKey},
+		{Account: "options", PublicKey: publicKey, SSHOptions: `no-pty,port-forwarding,agent-forwarding,from="10.0.0.0/8"`},
+		{Account: "forbidden", PublicKey: publicKey, SSHOptions: `permitopen="localhost:8080"`},
+		{Account: "forbidden-case", PublicKey: publicKey, SSHOptions: `Environment="A=B"`},
+		{Account: "from-conflict", PublicKey: publicKey, SSHOptions: `from="0.0.0.0/0"`},
+		{Account: "command", PublicKey: publicKey, SSHOptions: `command="/usr/bin/backup"`},
+	}
+	filtered := filterKeysBySSHOptionsPolicy(keys)
+	expected := map[string]string{
+		"plain":   `no-port-forwarding,no-agent-forwarding,from="10.0.0.0/8" ` + publicKey + "\n",
+		"options": `no-pty,from="10.0.0.0/8",no-port-forwarding,no-agent-forwarding ` + publicKey + "\n",
+		"command": `command="/usr/bin/backup",no-port-forwarding,no-agent-forwarding,from="10.0.0.0/8" ` + publicKey + "\n",
+	}
+	if len(filtered) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), len(filtered))
+	}
+	for _, key := range filtered {
+		line, err := getAuthorizedKeysLine(key)
+		if err != nil {
+			t.Errorf("getAuthorizedKeysLine(%s) failed: %s", key.Account, err)
+		}
+		if line != expected[key.Account] {
+			t.Errorf("Unexpected line for %s: %s", key.Account, line)
+		}
+	}
+	if _, err := getAuthorizedKeysLine(keys[4]); err == nil {
+		t.Errorf("Conflicting from option must fail")
+	}
+}
+
+func TestMergeSSHOptionsRestrict(t *testing.T) {
+	options, _ := parseSSHOptions(`pty,x11-forwarding,permitopen="localhost:80"`)
+	mandatory, _ := parseSSHOptions("restrict")
+	merged, err := mergeSSHOptions(options, mandatory)
+	if err != nil {
+		t.Fatalf("mergeSSHOptions failed: %s", err)
+	}
+	if formatted := formatSSHOptions(merged); formatted != `permitopen="localhost:80",restrict` {
+		t.Errorf("Unexpected options %s", formatted)
+	}
+
+	config.MandatorySSHOptions = "no-such-option"
+	defer func() {
+		config.MandatorySSHOptions = ""
+	}()
+	if filtered := filterKeysBySSHOptionsPolicy([]Key{{Account: "a"}}); len(filtered) != 0 {
+		t.Errorf("Invalid mandatory_ssh_options must reject every key")
+	}
+}
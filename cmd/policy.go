@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+	"golang.org/x/crypto/ssh"
+)
+
+// AccessPolicy restricts, locally, the accounts allowed to log in as each user
+type AccessPolicy struct {
+	// Default is "allow" (the default) or "deny": what happens to accounts no rule matches
+	Default string
+	Rules   []AccessRule
+}
+
+// AccessRule applies to login users matching User (see path.Match, empty matches any).
+// Accounts matching Deny are refused; when Allow is not empty, only matching accounts are accepted.
+// Rules with only a Deny list leave the other accounts to the next rules.
+type AccessRule struct {
+	User  string
+	Allow []string
+	Deny  []string
+}
+
+const (
+	K_ACCESS_ALLOW = "allow"
+	K_ACCESS_DENY  = "deny"
+)
+
+// KeyPolicy restricts the accepted key algorithms and sizes
+type KeyPolicy struct {
+	// AllowedTypes lists the accepted key types (e.g. ssh-ed25519, sk-ssh-ed25519@openssh.com), empty means any
+	AllowedTypes []string `yaml:"allowed_types"`
+	// MinRSABits is the minimum RSA modulus size
+	MinRSABits int `yaml:"min_rsa_bits"`
+	// RequireSKUsers lists the login user patterns (see path.Match) that require FIDO (sk-*) keys
+	RequireSKUsers []string `yaml:"require_sk_users"`
+}
+
+// SourceRule restricts the client addresses keys can be used from.
+// Account and User are patterns (see path.Match) matched against the key account
+// and the login user, empty matches any. A key must connect from an address in the
+// Allow list, when not empty, of every rule matching it, and in none of their Deny lists.
+type SourceRule struct {
+	Account string
+	User    string
+	Allow   []string
+	Deny    []string
+}
+
+func (r SourceRule) applies(account string, user string) bool {
+	return matchPattern(r.Account, strings.ToLower(account), true) && matchPattern(r.User, user, false)
+}
+
+// matchPattern matches s against pattern, an empty pattern matches anything
+func matchPattern(pattern string, s string, fold bool) bool {
+	if pattern == "" {
+		return true
+	}
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
+
+// filterKeysBySourcePolicy drops the keys that source_policy does not allow from the client address.
+// Keys covered by a rule are dropped when the client address is not known: sshd only passes
+// the connection (%C) from OpenSSH 9.4.
+func filterKeysBySourcePolicy(rules []SourceRule, connection *Connection, user string, keys []Key) []Key {
+	if len(rules) == 0 {
+		return keys
+	}
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		reason := checkSourcePolicy(rules, connection, user, keys[i].Account)
+		if reason != "" {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, reason)
+			a, b := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "AUTH", "theo-agent")
+			if b == nil {
+				a.Write([]byte(fmt.Sprintf("Denied key of account %s to log in as %s%s: %s\n", keys[i].Account, user, getConnectionLog(connection), reason)))
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+// checkSourcePolicy returns why account can not log in as user from connection, empty when allowed
+func checkSourcePolicy(rules []SourceRule, connection *Connection, user string, account string) string {
+	for _, rule := range rules {
+		if !rule.applies(account, user) {
+			continue
+		}
+		if connection == nil {
+			if len(rule.Allow) > 0 || len(rule.Deny) > 0 {
+				return "client address unknown"
+			}
+			continue
+		}
+		client := connection.Client.Addr()
+		in, err := prefixesContain(rule.Deny, client)
+		if err != nil {
+			return fmt.Sprintf("source_policy: %s", err)
+		}
+		if in {
+			return fmt.Sprintf("source address %s denied", client)
+		}
+		if len(rule.Allow) == 0 {
+			continue
+		}
+		in, err = prefixesContain(rule.Allow, client)
+		if err != nil {
+			return fmt.Sprintf("source_policy: %s", err)
+		}
+		if !in {
+			return fmt.Sprintf("source address %s not allowed", client)
+		}
+	}
+	return ""
+}
+
+// prefixesContain reports whether addr is in one of prefixes (CIDR notation, or single addresses)
+func prefixesContain(prefixes []string, addr netip.Addr) (bool, error) {
+	for _, s := range prefixes {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(s, "/") {
+			prefix, err = netip.ParsePrefix(s)
+		} else {
+			var a netip.Addr
+			a, err = netip.ParseAddr(s)
+			prefix = netip.PrefixFrom(a, a.BitLen())
+		}
+		if err != nil {
+			return false, fmt.Errorf("invalid address %q", s)
+		}
+		if prefix.Masked().Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// filterKeysByKeyPolicy drops the keys whose type or size key_policy does not accept
+func filterKeysByKeyPolicy(policy KeyPolicy, user string, keys []Key) []Key {
+	if len(policy.AllowedTypes) == 0 && policy.MinRSABits == 0 && len(policy.RequireSKUsers) == 0 {
+		return keys
+	}
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		reason := checkKeyPolicy(policy, user, keys[i].PublicKey)
+		if reason != "" {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, reason)
+			}
+			a, b := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "AUTH", "theo-agent")
+			if b == nil {
+				a.Write([]byte(fmt.Sprintf("Denied key of account %s to log in as %s: %s\n", keys[i].Account, user, reason)))
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+// checkKeyPolicy returns why publicKey is not accepted for user, empty when accepted
+func checkKeyPolicy(policy KeyPolicy, user string, publicKey string) string {
+	pk, err := parseSSHPublicKey(publicKey)
+	if err != nil {
+		return fmt.Sprintf("unable to parse key: %s", err)
+	}
+	keyType := pk.Type()
+	if len(policy.AllowedTypes) > 0 {
+		allowed := false
+		for _, t := range policy.AllowedTypes {
+			if t == keyType {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("key type %s not allowed", keyType)
+		}
+	}
+	if keyType == ssh.KeyAlgoRSA && policy.MinRSABits > 0 {
+		if cpk, ok := pk.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < policy.MinRSABits {
+				return fmt.Sprintf("RSA key size %d is less than %d", rsaKey.N.BitLen(), policy.MinRSABits)
+			}
+		}
+	}
+	if !strings.HasPrefix(keyType, "sk-") {
+		for _, pattern := range policy.RequireSKUsers {
+			if matchPattern(pattern, user, false) {
+				return fmt.Sprintf("user %s requires a FIDO (sk-*) key", user)
+			}
+		}
+	}
+	return ""
+}
+
+// filterKeysByAccessPolicy drops the keys of accounts not allowed to log in as user
+func filterKeysByAccessPolicy(policy AccessPolicy, user string, keys []Key) []Key {
+	if policy.Default == "" && len(policy.Rules) == 0 {
+		return keys
+	}
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		reason := checkAccessPolicy(policy, user, keys[i].Account)
+		if reason != "" {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, reason)
+			a, b := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "AUTH", "theo-agent")
+			if b == nil {
+				a.Write([]byte(fmt.Sprintf("Denied key of account %s to log in as %s: %s\n", keys[i].Account, user, reason)))
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+// checkAccessPolicy returns why account can not log in as user, empty when allowed.
+// Rules are evaluated in order, the first one matching user decides when it denies account,
+// or when it has an allow list: accounts not in it are denied. Accounts no rule decides for get the default.
+func checkAccessPolicy(policy AccessPolicy, user string, account string) string {
+	account = strings.ToLower(account)
+	for _, rule := range policy.Rules {
+		if !matchPattern(rule.User, user, false) {
+			continue
+		}
+		if matchAnyPattern(rule.Deny, account) {
+			return fmt.Sprintf("account denied for user %s", user)
+		}
+		if len(rule.Allow) == 0 {
+			continue
+		}
+		if matchAnyPattern(rule.Allow, account) {
+			return ""
+		}
+		return fmt.Sprintf("account not allowed for user %s", user)
+	}
+	if policy.Default == K_ACCESS_DENY {
+		return fmt.Sprintf("no access rule allows account for user %s", user)
+	}
+	return ""
+}
+
+// matchAnyPattern reports whether account matches one of patterns, case insensitively
+func matchAnyPattern(patterns []string, account string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, account, true) {
+			return true
+		}
+	}
+	return false
+}
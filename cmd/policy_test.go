@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSourcePolicy(t *testing.T) {
+	cfg, ret := parseConfig("../test/config.8.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	if len(cfg.SourcePolicy) != 3 {
+		t.Fatalf("Expected 3 source rules, got %d", len(cfg.SourcePolicy))
+	}
+	keys := []Key{{Account: "bob@contractor.example.com"}, {Account: "alice@example.com"}}
+	tests := []struct {
+		connection string
+		user       string
+		accounts   []string
+	}{
+		{"10.1.2.3 50000 10.0.0.1 22", "deploy", []string{"bob@contractor.example.com", "alice@example.com"}},
+		{"172.16.0.1 50000 10.0.0.1 22", "deploy", []string{"alice@example.com"}},
+		{"10.66.0.1 50000 10.0.0.1 22", "deploy", []string{}},
+		{"192.0.2.1 50000 10.0.0.1 22", "root", []string{"alice@example.com"}},
+		{"2001:db8::1 50000 2001:db8::2 22", "root", []string{"alice@example.com"}},
+		{"10.1.2.3 50000 10.0.0.1 22", "root", []string{}},
+		{"", "deploy", []string{}},
+	}
+	for _, test := range tests {
+		var connection *Connection
+		if test.connection != "" {
+			connection, _ = parseConnection(test.connection)
+		}
+		filtered := filterKeysBySourcePolicy(cfg.SourcePolicy, connection, test.user, keys)
+		if len(filtered) != len(test.accounts) {
+			t.Errorf("%q as %s: expected %v, got %d keys", test.connection, test.user, test.accounts, len(filtered))
+			continue
+		}
+		for i, account := range test.accounts {
+			if filtered[i].Account != account {
+				t.Errorf("%q as %s: expected %v, got %s", test.connection, test.user, test.accounts, filtered[i].Account)
+			}
+		}
+	}
+
+	if filtered := filterKeysBySourcePolicy(nil, nil, "root", keys); len(filtered) != len(keys) {
+		t.Errorf("No source policy must keep every key")
+	}
+	invalid := []SourceRule{{Allow: []string{"10.0.0.0/33"}}}
+	connection, _ := parseConnection("10.1.2.3 50000 10.0.0.1 22")
+	if filtered := filterKeysBySourcePolicy(invalid, connection, "root", keys); len(filtered) != 0 {
+		t.Errorf("Invalid source policy must deny keys it applies to")
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	cfg, ret := parseConfig("../test/config.10.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	newKey := func(account string, pk ssh.PublicKey) Key {
+		return Key{Account: account, PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))}
+	}
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	ed, _ := ssh.NewPublicKey(edPublic)
+	rsa1024, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaSmall, _ := ssh.NewPublicKey(&rsa1024.PublicKey)
+	rsa2048, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaLarge, _ := ssh.NewPublicKey(&rsa2048.PublicKey)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec, _ := ssh.NewPublicKey(&ecKey.PublicKey)
+	skBlob := ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, edPublic, "ssh:"})
+	sk, err := ssh.ParsePublicKey(skBlob)
+	if err != nil {
+		t.Fatalf("Unable to build sk key: %s", err)
+	}
+	keys := []Key{
+		newKey("ed25519", ed),
+		newKey("rsa-1024", rsaSmall),
+		newKey("rsa-2048", rsaLarge),
+		newKey("ecdsa", ec),
+		newKey("sk", sk),
+	}
+	tests := []struct {
+		user     string
+		accounts string
+	}{
+		{"deploy", "ed25519,rsa-2048,sk"},
+		{"root", "sk"},
+		{"admin-db", "sk"},
+	}
+	for _, test := range tests {
+		filtered := filterKeysByKeyPolicy(cfg.KeyPolicy, test.user, keys)
+		accounts := make([]string, 0, len(filtered))
+		for _, key := range filtered {
+			accounts = append(accounts, key.Account)
+		}
+		if strings.Join(accounts, ",") != test.accounts {
+			t.Errorf("%s: expected %s, got %v", test.user, test.accounts, accounts)
+		}
+	}
+	if filtered := filterKeysByKeyPolicy(KeyPolicy{}, "root", keys); len(filtered) != len(keys) {
+		t.Errorf("Empty key policy must keep every key")
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	cfg, ret := parseConfig("../test/config.11.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	if cfg.Access.Default != K_ACCESS_DENY || len(cfg.Access.Rules) != 3 {
+		t.Fatalf("Unexpected access policy %+v", cfg.Access)
+	}
+	keys := []Key{
+		{Account: "jenkins@ci.example.com"},
+		{Account: "Release-Manager@corp.example.com"},
+		{Account: "dev@corp.example.com"},
+		{Account: "intern@corp.example.com"},
+		{Account: "someone@example.org"},
+	}
+	tests := []struct {
+		user     string
+		accounts string
+	}{
+		{"deploy", "jenkins@ci.example.com,Release-Manager@corp.example.com"},
+		{"alice", "Release-Manager@corp.example.com,dev@corp.example.com"},
+	}
+	for _, test := range tests {
+		filtered := filterKeysByAccessPolicy(cfg.Access, test.user, keys)
+		accounts := make([]string, 0, len(filtered))
+		for _, key := range filtered {
+			accounts = append(accounts, key.Account)
+		}
+		if strings.Join(accounts, ",") != test.accounts {
+			t.Errorf("%s: expected %s, got %v", test.user, test.accounts, accounts)
+		}
+	}
+
+	cfg.Access.Rules = cfg.Access.Rules[:2]
+	filtered := filterKeysByAccessPolicy(cfg.Access, "deploy", keys)
+	if len(filtered) != 2 || filtered[0].Account != "jenkins@ci.example.com" {
+		t.Errorf("deploy: expected 2 keys, got %+v", filtered)
+	}
+	if filtered := filterKeysByAccessPolicy(cfg.Access, "alice", keys); len(filtered) != 0 {
+		t.Errorf("Default deny must reject accounts no rule allows, got %d keys", len(filtered))
+	}
+	cfg.Access.Default = K_ACCESS_ALLOW
+	if filtered := filterKeysByAccessPolicy(cfg.Access, "alice", keys); len(filtered) != 4 {
+		t.Errorf("Default allow must only reject denied accounts, got %d keys", len(filtered))
+	}
+	cfg.Access.Rules = []AccessRule{{User: "deploy", Allow: []string{"intern@corp.example.com"}}, {Deny: []string{"intern@corp.example.com"}}}
+	if reason := checkAccessPolicy(cfg.Access, "deploy", "intern@corp.example.com"); reason != "" {
+		t.Errorf("First matching rule must win, got %q", reason)
+	}
+	if reason := checkAccessPolicy(cfg.Access, "alice", "intern@corp.example.com"); reason == "" {
+		t.Errorf("Rules not matching the user must be skipped")
+	}
+
+	if _, ret := parseConfig("../test/config.17.yml"); ret != 7 {
+		t.Errorf("Invalid access default must be rejected with 7, got %d", ret)
+	}
+}
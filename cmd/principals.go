@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	urlu "net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+	"golang.org/x/crypto/ssh"
+)
+
+// Principal is a certificate principal allowed to log in, as returned by theo-node
+type Principal struct {
+	Principal string `json:"principal"`
+	Account   string `json:"email"`
+	Signature string `json:"principal_sig"`
+	// KeyID is the ID, or fingerprint, of the public key that made Signature
+	KeyID string `json:"key_id,omitempty"`
+	// Signatures holds additional signatures, by other signers, of the same payload as Signature
+	Signatures []KeySignature `json:"signatures,omitempty"`
+}
+
+// principalPayload is the wire encoded (RFC 4251 strings) message signed for a Principal
+type principalPayload struct {
+	Magic     string
+	Principal string
+	Account   string
+	User      string
+	Host      string
+}
+
+const principalMagic = "theo-agent-principal-v1"
+
+// QueryPrincipals prints the certificate principals allowed to log in as user,
+// it is meant to be used as sshd AuthorizedPrincipalsCommand
+func QueryPrincipals(user string) {
+	var ret int
+	config, ret = parseConfig("")
+	if ret > 0 {
+		os.Exit(ret)
+	}
+	var principals []Principal
+	_theoURLs := getTheoURLs()
+	_theoToken := config.Token
+	if *theoAccessToken != "" {
+		_theoToken = *theoAccessToken
+	}
+	body, ret, server := performPrincipalsQuery(user, _theoURLs, _theoToken)
+	if *debug {
+		fmt.Fprintf(os.Stderr, "%s", body)
+	}
+	principalsCacheFile := getPrincipalsFilename(user)
+	if ret == 0 {
+		if err := json.Unmarshal(body, &principals); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to parse json response : %s\n", err)
+			os.Exit(9)
+		}
+		ret = writePrincipalsCacheFile(principalsCacheFile, principals)
+	} else {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Try to read cached principals for %s\n", user)
+		}
+		var err error
+		principals, err = loadPrincipalsCacheFile(principalsCacheFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read cached principals: %s\n", err)
+			os.Exit(9)
+		}
+		ret = 0
+	}
+	principals = validatePrincipals(principals)
+	if mustVerify() {
+		var err error
+		principals, err = verifyPrincipals(getPublicKeys(), principals, user, loadHostname())
+		if err != nil {
+			os.Exit(9)
+		}
+	}
+	if *sshFingerprint != "" && len(principals) > 0 {
+		a, b := gsyslog.NewLogger(gsyslog.LOG_INFO, "AUTH", "theo-agent")
+		if b == nil {
+			a.Write([]byte(fmt.Sprintf("Certificate %s allowed to log in as %s%s with principals %s%s\n", *sshFingerprint, user, getConnectionLog(getConnection()), strings.Join(getPrincipalNames(principals), ","), getServerLog(server))))
+		}
+	}
+	printPrincipals(principals)
+	os.Exit(ret)
+}
+
+func performPrincipalsQuery(user string, urls []string, token string) ([]byte, int, string) {
+	remotePath := fmt.Sprintf("authorized_principals/%s/%s", urlu.PathEscape(loadHostname()), urlu.PathEscape(user))
+
+	q := urlu.Values{}
+	if *sshFingerprint != "" {
+		q.Add("f", *sshFingerprint)
+	}
+	addConnectionParams(q, getConnection())
+	return performFailoverRequest(http.MethodGet, urls, token, remotePath, q, nil)
+}
+
+func getPrincipalsFilename(user string) string {
+	return fmt.Sprintf("%s/.%s.principals.json", getCacheDir(), user)
+}
+
+func writePrincipalsCacheFile(principalsCacheFile string, principals []Principal) int {
+	body, _ := json.Marshal(principals)
+	err := ioutil.WriteFile(principalsCacheFile, body, 0644)
+	if err != nil {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Unable to write cache file (%s): %s\n", principalsCacheFile, err)
+		}
+		return 21
+	}
+	return 0
+}
+
+func loadPrincipalsCacheFile(principalsCacheFile string) ([]Principal, error) {
+	data, err := ioutil.ReadFile(principalsCacheFile)
+	if err != nil {
+		return nil, err
+	}
+	var principals []Principal
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return nil, err
+	}
+	return principals, nil
+}
+
+// validatePrincipals drops every principal that cannot be safely written as an authorized_principals line
+func validatePrincipals(principals []Principal) []Principal {
+	retPrincipals := make([]Principal, 0, len(principals))
+	for i := 0; i < len(principals); i++ {
+		if err := validatePrincipal(principals[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "Rejected principal #%d (account %q): %s\n", i, principals[i].Account, err)
+			continue
+		}
+		retPrincipals = append(retPrincipals, principals[i])
+	}
+	return retPrincipals
+}
+
+func validatePrincipal(principal Principal) error {
+	if principal.Principal == "" {
+		return errors.New("empty principal")
+	}
+	if strings.HasPrefix(principal.Principal, "#") {
+		return errors.New("principal must not start with #")
+	}
+	for i := 0; i < len(principal.Principal); i++ {
+		c := principal.Principal[i]
+		if c <= ' ' || c == 0x7f || c == ',' {
+			return fmt.Errorf("principal contains invalid character %q at offset %d", c, i)
+		}
+	}
+	if i := indexControlChar(principal.Account); i >= 0 {
+		return fmt.Errorf("email contains control character %q at offset %d", principal.Account[i], i)
+	}
+	if err := validateSignature(principal.Signature); err != nil {
+		return fmt.Errorf("principal_sig: %s", err)
+	}
+	for _, signature := range principal.Signatures {
+		if err := validateSignature(signature.Signature); err != nil {
+			return fmt.Errorf("signatures: %s", err)
+		}
+	}
+	return nil
+}
+
+// verifyPrincipals keeps the principals signed, for user on host, by verify_quorum trusted keys
+func verifyPrincipals(publicKeys PublicKeyList, principals []Principal, user string, host string) ([]Principal, error) {
+	trustedKeys := loadTrustedKeys(publicKeys)
+	if len(trustedKeys) == 0 {
+		return nil, errors.New("no usable public key to verify signatures")
+	}
+	quorum := getVerifyQuorum(host)
+	if quorum > len(trustedKeys) {
+		fmt.Fprintf(os.Stderr, "verify_quorum is %d, but only %d public keys are usable\n", quorum, len(trustedKeys))
+		return nil, fmt.Errorf("verify_quorum %d can not be reached", quorum)
+	}
+
+	retPrincipals := make([]Principal, 0)
+	for x := 0; x < len(principals); x++ {
+		principal := principals[x]
+		payload := ssh.Marshal(principalPayload{
+			Magic:     principalMagic,
+			Principal: principal.Principal,
+			Account:   principal.Account,
+			User:      user,
+			Host:      host,
+		})
+		verifiedBy := verifySignatures(trustedKeys, payload, getSignatures(principal.Signature, principal.KeyID, principal.Signatures))
+		if len(verifiedBy) < quorum {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Error from verification: principal #%d (%s) signed by %d trusted keys, %d required\n", x, principal.Account, len(verifiedBy), quorum)
+			}
+			continue
+		}
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Principal #%d (%s) verified by %s\n", x, principal.Account, strings.Join(verifiedBy, ", "))
+		}
+		retPrincipals = append(retPrincipals, principal)
+	}
+	return retPrincipals, nil
+}
+
+// getPrincipalNames returns the distinct principal names, in order
+func getPrincipalNames(principals []Principal) []string {
+	names := make([]string, 0, len(principals))
+	seen := make(map[string]bool, len(principals))
+	for _, principal := range principals {
+		if seen[principal.Principal] {
+			continue
+		}
+		seen[principal.Principal] = true
+		names = append(names, principal.Principal)
+	}
+	return names
+}
+
+func printPrincipals(principals []Principal) {
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+	for _, name := range getPrincipalNames(principals) {
+		_, err := fmt.Println(name)
+		if err != nil {
+			break
+		}
+	}
+}
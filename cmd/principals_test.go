@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPrincipals(t *testing.T) {
+	principals, err := loadPrincipalsCacheFile("../test/test.principals.json")
+	if err != nil {
+		t.Fatalf("Failed to read principals: %s", err)
+	}
+	principals = validatePrincipals(principals)
+	if len(principals) != 3 {
+		t.Fatalf("Expected 3 valid principals, got %d", len(principals))
+	}
+	verified, err := verifyPrincipals(newPublicKeyList("../test/public-ed25519.pem"), principals, "test", "test-host")
+	if err != nil {
+		t.Fatalf("verifyPrincipals failed: %s", err)
+	}
+	names := getPrincipalNames(verified)
+	if strings.Join(names, ",") != "macno,ops" {
+		t.Errorf("Expected principals macno,ops got %v", names)
+	}
+
+	verified, _ = verifyPrincipals(newPublicKeyList("../test/public-ed25519.pem"), principals, "root", "test-host")
+	if len(verified) != 0 {
+		t.Errorf("Principals signed for another user must be rejected, got %d", len(verified))
+	}
+	verified, _ = verifyPrincipals(newPublicKeyList("../test/public-ed25519-2.pem"), principals, "test", "test-host")
+	if len(verified) != 0 {
+		t.Errorf("Principals signed by an untrusted key must be rejected, got %d", len(verified))
+	}
+	tampered := []Principal{principals[0]}
+	tampered[0].Principal = "root"
+	verified, _ = verifyPrincipals(newPublicKeyList("../test/public-ed25519.pem"), tampered, "test", "test-host")
+	if len(verified) != 0 {
+		t.Errorf("Tampered principal must be rejected")
+	}
+}
+
+func TestValidatePrincipals(t *testing.T) {
+	principals := []Principal{
+		{Principal: "ok"},
+		{Principal: ""},
+		{Principal: "two words"},
+		{Principal: "line\nbreak"},
+		{Principal: "a,b"},
+		{Principal: "#comment"},
+		{Principal: "ok", Signature: "not hex"},
+	}
+	valid := validatePrincipals(principals)
+	if len(valid) != 1 || valid[0].Principal != "ok" {
+		t.Errorf("Expected only 1 valid principal, got %+v", valid)
+	}
+}
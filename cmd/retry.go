@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	urlu "net/url"
+	"os"
+	"time"
+)
+
+const (
+	K_DEFAULT_TIMEOUT       = int64(5000)
+	K_DEFAULT_RETRY_BACKOFF = int64(100)
+	// K_MAX_RETRY_SHIFT caps the exponential growth of the retry delay
+	K_MAX_RETRY_SHIFT = 10
+)
+
+// getRequestTimeout returns the time budget of a request to Theo servers, retries and failover included
+func getRequestTimeout() time.Duration {
+	timeout := K_DEFAULT_TIMEOUT
+	if config.Timeout > 0 {
+		timeout = config.Timeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// isRetryableStatus reports whether a HTTP error is transient: a 5xx means Theo server, or a proxy
+// in front of it, is failing. Other errors, like 401, 403 or 404, will get the same answer if retried.
+func isRetryableStatus(status int) bool {
+	return status >= http.StatusInternalServerError
+}
+
+// getRetryDelay returns how long to wait before retry number attempt+1: retry_backoff doubled at each
+// retry, with a random jitter so that agents failing together do not retry together
+func getRetryDelay(attempt int) time.Duration {
+	backoff := K_DEFAULT_RETRY_BACKOFF
+	if config.RetryBackoff > 0 {
+		backoff = config.RetryBackoff
+	}
+	if attempt > K_MAX_RETRY_SHIFT {
+		attempt = K_MAX_RETRY_SHIFT
+	}
+	delay := time.Duration(backoff) * time.Millisecond << uint(attempt)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return delay/2 + time.Duration(r.Int63n(int64(delay/2)+1))
+}
+
+// performRequestWithRetries makes the request, retrying up to retries times on transient errors.
+// It never waits past the deadline of ctx, giving up with the last error instead, and whether it was transient.
+func performRequestWithRetries(ctx context.Context, method string, url string, token string, remotePath string, q urlu.Values, body []byte) ([]byte, int, bool) {
+	for attempt := 0; ; attempt++ {
+		respBody, ret, retryable := performSingleRequest(ctx, method, url, token, remotePath, q, body)
+		if ret == 0 || !retryable || attempt >= config.Retries {
+			// Running out of time is transient too: the server is not answering
+			return respBody, ret, retryable || ctx.Err() != nil
+		}
+		delay := getRetryDelay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "No time left to retry %s\n", url)
+			}
+			return nil, ret, true
+		}
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Retrying %s in %s (retry %d of %d)\n", url, delay, attempt+1, config.Retries)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ret, true
+		}
+	}
+}
+
+// withServerShare returns a context expiring once the server has used its share of the time left in ctx,
+// so that a server not answering leaves time to the servers still to try
+func withServerShare(ctx context.Context, serversLeft int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || serversLeft < 2 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(serversLeft))
+}
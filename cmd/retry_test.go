@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseConfigRetries(t *testing.T) {
+	cfg, ret := parseConfig("../test/config.15.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	if cfg.Retries != 3 || cfg.RetryBackoff != 50 || cfg.Timeout != 2000 {
+		t.Errorf("Unexpected retries %d, backoff %d, timeout %d", cfg.Retries, cfg.RetryBackoff, cfg.Timeout)
+	}
+}
+
+func TestGetRetryDelay(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.RetryBackoff = 100
+	for attempt := 0; attempt < 3; attempt++ {
+		max := 100 * time.Millisecond << uint(attempt)
+		for i := 0; i < 10; i++ {
+			delay := getRetryDelay(attempt)
+			if delay < max/2 || delay > max {
+				t.Errorf("Delay of retry %d must be between %s and %s, got %s", attempt+1, max/2, max, delay)
+			}
+		}
+	}
+	if delay := getRetryDelay(100); delay > 100*time.Millisecond<<K_MAX_RETRY_SHIFT {
+		t.Errorf("Delay must be capped, got %s", delay)
+	}
+}
+
+func TestPerformRequestRetries(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Retries = 2
+	config.RetryBackoff = 1
+	ctx, cancel := context.WithTimeout(context.Background(), getRequestTimeout())
+	defer cancel()
+
+	requests := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer flaky.Close()
+	body, ret, _ := performRequestWithRetries(ctx, http.MethodGet, flaky.URL, "token", "authorized_keys/host/user", nil, nil)
+	if ret > 0 || string(body) != "[]" || requests != 3 {
+		t.Errorf("Expected success after 2 retries, got ret %d after %d requests", ret, requests)
+	}
+
+	requests = 0
+	config.Retries = 1
+	_, ret, _ = performRequestWithRetries(ctx, http.MethodGet, flaky.URL, "token", "authorized_keys/host/user", nil, nil)
+	if ret != 20 || requests != 2 {
+		t.Errorf("Expected failure after 1 retry, got ret %d after %d requests", ret, requests)
+	}
+
+	config.Retries = 3
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		requests = 0
+		terminal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(status)
+		}))
+		_, ret, _ = performRequestWithRetries(ctx, http.MethodGet, terminal.URL, "token", "authorized_keys/host/user", nil, nil)
+		terminal.Close()
+		if ret != 20 || requests != 1 {
+			t.Errorf("HTTP %d must not be retried, got ret %d after %d requests", status, ret, requests)
+		}
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	if _, ret, _ = performRequestWithRetries(ctx, http.MethodGet, down.URL, "token", "authorized_keys/host/user", nil, nil); ret != 9 {
+		t.Errorf("Expected 9 from a server down, got %d", ret)
+	}
+}
+
+func TestPerformRequestDeadline(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Timeout = 300
+	config.Retries = 100
+	config.RetryBackoff = 50
+
+	requests := 0
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), getRequestTimeout())
+	defer cancel()
+	_, ret, _ := performRequestWithRetries(ctx, http.MethodGet, failing.URL, "token", "authorized_keys/host/user", nil, nil)
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Retries must stop at the timeout, took %s", elapsed)
+	}
+	if ret != 20 || requests < 2 || requests > 100 {
+		t.Errorf("Unexpected ret %d after %d requests", ret, requests)
+	}
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer hanging.Close()
+	config.Cachedir = t.TempDir()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer up.Close()
+	start = time.Now()
+	body, ret, server := performFailoverRequest(http.MethodGet, []string{hanging.URL, up.URL}, "token", "authorized_keys/host/user", nil, nil)
+	if ret > 0 || server != up.URL || string(body) != "[]" {
+		t.Errorf("A hanging server must leave time to the next one, got %s (ret %d)", server, ret)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Failover must stay within the timeout, took %s", elapsed)
+	}
+}
+
+func TestWithServerShare(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	serverCtx, serverCancel := withServerShare(ctx, 4)
+	defer serverCancel()
+	deadline, _ := serverCtx.Deadline()
+	if left := time.Until(deadline); left > 300*time.Millisecond {
+		t.Errorf("Each of 4 servers must get a quarter of the time left, got %s", left)
+	}
+}
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+	"golang.org/x/crypto/ssh"
+)
+
+// RevocationList lists revoked keys, by fingerprint, and revoked accounts
+type RevocationList struct {
+	// Serial increases with every new list, older lists are never accepted over newer ones
+	Serial       int64    `json:"serial"`
+	Fingerprints []string `json:"fingerprints"`
+	Accounts     []string `json:"accounts"`
+}
+
+// SignedRevocationList is the object returned by theo-node. RevocationList holds the
+// JSON encoded list as a string, so that the signed bytes can be verified as they are.
+type SignedRevocationList struct {
+	RevocationList string         `json:"revocation_list"`
+	Signature      string         `json:"signature"`
+	KeyID          string         `json:"key_id,omitempty"`
+	Signatures     []KeySignature `json:"signatures,omitempty"`
+}
+
+// revocationPayload is the wire encoded message signed by the server
+type revocationPayload struct {
+	Magic          string
+	RevocationList string
+}
+
+const revocationMagic = "theo-agent-revocations-v1"
+
+func getRevocationsFilename() string {
+	return fmt.Sprintf("%s/revocations.json", getCacheDir())
+}
+
+// loadRevocationList fetches the revocation list from Theo servers, within the deadline of ctx, falling
+// back to the cached one, which is the only one used when urls is empty or no time is left.
+// A fetched list with a lower serial than the cached one is ignored, so that old lists can not be replayed.
+func loadRevocationList(ctx context.Context, urls []string, token string) *RevocationList {
+	revocationsFile := getRevocationsFilename()
+	var cached *RevocationList
+	data, err := ioutil.ReadFile(revocationsFile)
+	if err == nil {
+		cached, err = parseRevocationList(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring cached revocation list (%s): %s\n", revocationsFile, err)
+		}
+	} else if *debug {
+		fmt.Fprintf(os.Stderr, "Unable to read revocation list (%s): %s\n", revocationsFile, err)
+	}
+
+	if len(urls) == 0 || ctx.Err() != nil {
+		return cached
+	}
+	body, ret, server := performFailoverRequestContext(ctx, http.MethodGet, urls, token, "revocations", nil, nil)
+	if ret > 0 {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Using cached revocation list\n")
+		}
+		return cached
+	}
+	fetched, err := parseRevocationList(body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring revocation list from %s: %s\n", server, err)
+		return cached
+	}
+	if cached != nil {
+		if err := checkSerial(fetched.Serial, cached.Serial); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring revocation list from %s: %s\n", server, err)
+			return cached
+		}
+	}
+	err = ioutil.WriteFile(revocationsFile, body, 0644)
+	if err != nil && *debug {
+		fmt.Fprintf(os.Stderr, "Unable to write cache file (%s): %s\n", revocationsFile, err)
+	}
+	return fetched
+}
+
+// checkSerial fails when a fetched list is older than the cached one, as when an old response is replayed
+func checkSerial(serial int64, cachedSerial int64) error {
+	if serial < cachedSerial {
+		return fmt.Errorf("serial %d is older than cached %d", serial, cachedSerial)
+	}
+	return nil
+}
+
+// parseRevocationList decodes a SignedRevocationList, verifying its signature when -verify is on
+func parseRevocationList(data []byte) (*RevocationList, error) {
+	var signed SignedRevocationList
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+	if mustVerify() {
+		if err := verifyRevocationList(signed); err != nil {
+			return nil, err
+		}
+	}
+	var list RevocationList
+	if err := json.Unmarshal([]byte(signed.RevocationList), &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// verifyRevocationList checks the list has been signed by at least one trusted key.
+// verify_quorum does not apply: revoking must never be harder than granting.
+func verifyRevocationList(signed SignedRevocationList) error {
+	trustedKeys := loadTrustedKeys(getPublicKeys())
+	payload := ssh.Marshal(revocationPayload{Magic: revocationMagic, RevocationList: signed.RevocationList})
+	verifiedBy := verifySignatures(trustedKeys, payload, getSignatures(signed.Signature, signed.KeyID, signed.Signatures))
+	if len(verifiedBy) == 0 {
+		return errors.New("revocation list not signed by any trusted key")
+	}
+	if *debug {
+		fmt.Fprintf(os.Stderr, "Revocation list verified by %s\n", strings.Join(verifiedBy, ", "))
+	}
+	return nil
+}
+
+// filterRevokedKeys drops the keys whose fingerprint or account has been revoked.
+// Without a revocation list no key can be checked, so every key is dropped.
+func filterRevokedKeys(list *RevocationList, keys []Key) []Key {
+	if list == nil {
+		for i := 0; i < len(keys); i++ {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): no revocation list available\n", i, keys[i].Account)
+		}
+		a, b := gsyslog.NewLogger(gsyslog.LOG_WARNING, "AUTH", "theo-agent")
+		if b == nil {
+			a.Write([]byte(fmt.Sprintf("Dropped %d keys: no revocation list available\n", len(keys))))
+		}
+		return []Key{}
+	}
+	fingerprints := make(map[string]bool, len(list.Fingerprints))
+	for _, fingerprint := range list.Fingerprints {
+		fingerprints[fingerprint] = true
+	}
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		reason := ""
+		fingerprint, err := getKeyFingerprint(keys[i].PublicKey)
+		if err != nil {
+			reason = fmt.Sprintf("unable to compute fingerprint: %s", err)
+		} else if fingerprints[fingerprint] {
+			reason = fmt.Sprintf("key %s revoked", fingerprint)
+		} else {
+			for _, account := range list.Accounts {
+				if strings.EqualFold(account, keys[i].Account) {
+					reason = "account revoked"
+					break
+				}
+			}
+		}
+		if reason != "" {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, reason)
+			a, b := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "AUTH", "theo-agent")
+			if b == nil {
+				a.Write([]byte(fmt.Sprintf("Dropped revoked key of account %s: %s\n", keys[i].Account, reason)))
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
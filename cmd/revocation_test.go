@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRevocationListSignature(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Verify = true
+	config.PublicKey = newPublicKeyList("../test/public-ed25519.pem")
+
+	data, err := ioutil.ReadFile("../test/test.revocations.json")
+	if err != nil {
+		t.Fatalf("Failed to read revocation list: %s", err)
+	}
+	list, err := parseRevocationList(data)
+	if err != nil {
+		t.Fatalf("parseRevocationList failed: %s", err)
+	}
+	if list.Serial != 2 || len(list.Fingerprints) != 1 || len(list.Accounts) != 1 {
+		t.Errorf("Unexpected revocation list %+v", list)
+	}
+
+	tampered := strings.Replace(string(data), `\"serial\":2`, `\"serial\":20`, 1)
+	if _, err := parseRevocationList([]byte(tampered)); err == nil {
+		t.Errorf("Tampered revocation list must be rejected")
+	}
+
+	config.PublicKey = newPublicKeyList("../test/public-ed25519-2.pem")
+	if _, err := parseRevocationList(data); err == nil {
+		t.Errorf("Revocation list signed by an untrusted key must be rejected")
+	}
+}
+
+func TestFilterRevokedKeys(t *testing.T) {
+	userCacheFile := "../test/test.signature-v2.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	list := &RevocationList{
+		Serial:       1,
+		Fingerprints: []string{"SHA256:d4RXf2B0bUGDaG0UufCX3+vUVxKnIvvIgTYC3bGGH14"},
+	}
+	filtered := filterRevokedKeys(list, keys)
+	if len(filtered) != 1 || filtered[0].Account != "theo@laptop" {
+		t.Errorf("Only theo@laptop key must be kept, got %d keys", len(filtered))
+	}
+	list.Accounts = []string{"Theo@Laptop"}
+	filtered = filterRevokedKeys(list, keys)
+	if len(filtered) != 0 {
+		t.Errorf("Keys len must be %d, got %d", 0, len(filtered))
+	}
+	filtered = filterRevokedKeys(nil, keys)
+	if len(filtered) != 0 {
+		t.Errorf("Keys must be rejected without a revocation list, got %d", len(filtered))
+	}
+}
+
+func TestLoadRevocationListRollback(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Cachedir = t.TempDir()
+
+	newList, _ := ioutil.ReadFile("../test/test.revocations.json")
+	oldList, _ := ioutil.ReadFile("../test/test.revocations-old.json")
+	served := newList
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/revocations" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(served)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), getRequestTimeout())
+	defer cancel()
+	list := loadRevocationList(ctx, []string{server.URL}, "token")
+	if list == nil || list.Serial != 2 {
+		t.Fatalf("Revocation list serial 2 expected, got %+v", list)
+	}
+
+	served = oldList
+	list = loadRevocationList(ctx, []string{server.URL}, "token")
+	if list == nil || list.Serial != 2 {
+		t.Errorf("Older revocation list must not replace the cached one, got %+v", list)
+	}
+
+	expired, expiredCancel := context.WithCancel(context.Background())
+	expiredCancel()
+	requested := false
+	late := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.Write(newList)
+	}))
+	defer late.Close()
+	list = loadRevocationList(expired, []string{late.URL}, "token")
+	if requested || list == nil || list.Serial != 2 {
+		t.Errorf("Cached revocation list expected, without request, once the time is spent, got %+v", list)
+	}
+
+	server.Close()
+	list = loadRevocationList(ctx, []string{server.URL}, "token")
+	if list == nil || list.Serial != 2 {
+		t.Errorf("Cached revocation list expected when server is down, got %+v", list)
+	}
+
+	list = loadRevocationList(ctx, nil, "token")
+	if list == nil || list.Serial != 2 {
+		t.Errorf("Cached revocation list expected without servers, got %+v", list)
+	}
+}
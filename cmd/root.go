@@ -30,10 +30,18 @@ var editSshdConfig = flag.Bool("sshd-config", false, "Edit sshd_config")
 var backupSshdConfig = flag.Bool("sshd-config-backup", false, "Make a backup copy of sshd_config")
 var pathSshdConfig = flag.String("sshd-config-path", "/etc/ssh/sshd_config", "The path to sshd_config")
 var sshFingerprint = flag.String("fingerprint", "", "The fingerprint of the key or certificate. (Token %f)")
+var sshKeyType = flag.String("key-type", "", "The type of the key or certificate. (Token %t)")
+var sshKey = flag.String("key", "", "The base64 encoded key or certificate. (Token %k)")
 var sshConnection = flag.String("connection", "", "The connection of the ssh session. (Token %C)")
 var cfgHostnamePrefix = flag.String("hostname-prefix", "", "Add a prefix to hostname when query server")
 var cfgHostnameSuffix = flag.String("hostname-suffix", "", "Add a suffix to hostname when query server")
 var passwordAuthentication = flag.Bool("with-password-authentication", false, "sshd: do not disable PasswordAuthentication (Use it only when testing!)")
+var principalsMode = flag.Bool("principals", false, "Print the certificate principals allowed to log in as LOGIN (for AuthorizedPrincipalsCommand)")
+var userCertificates = flag.Bool("with-user-certificates", false, "Trust user certificates signed by the CA keys published by Theo server: with -install also sets sshd options, alone refreshes the CA keys")
+var trustedUserCAKeysPath = flag.String("trusted-user-ca-keys-path", "/etc/ssh/theo_user_ca_keys", "The path to write Theo user CA keys to")
+var hostCertificates = flag.Bool("host-certificates", false, "Request host certificates from Theo server for the SSH host keys: with -install also sets HostCertificate, alone renews expiring certificates")
+var knownHosts = flag.Bool("known-hosts", false, "Fetch the known hosts from Theo server and write them to -known-hosts-path")
+var knownHostsPath = flag.String("known-hosts-path", "/etc/ssh/ssh_known_hosts", "The path to the ssh_known_hosts file managed by theo-agent")
 var useDNS = flag.Bool("with-use-dns", false, "sshd: set UseDNS option to yes - required when using hostnames/FQDNs in AuthorizedKeys 'from' directives")
 
 func Execute() {
@@ -52,10 +60,22 @@ func Execute() {
 		Install()
 		os.Exit(0)
 	}
+	if *hostCertificates {
+		RenewHostCertificates()
+	}
+	if *knownHosts {
+		KnownHosts()
+	}
+	if *userCertificates {
+		RefreshTrustedUserCAKeys()
+	}
 
 	if len(flag.Args()) < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *principalsMode {
+		QueryPrincipals(flag.Arg(0))
+	}
 	Query(flag.Arg(0))
 }
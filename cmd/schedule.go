@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	gsyslog "github.com/hashicorp/go-syslog"
+)
+
+// ScheduleRule limits when accounts can log in. It applies to login users matching User and
+// accounts matching Accounts (patterns, see path.Match, empty matches any) but not Except.
+// With Action "allow" the accounts can only log in during the window, with "deny" never during it.
+type ScheduleRule struct {
+	User     string
+	Accounts []string
+	Except   []string
+	Action   string
+	// Start and End limit the window to a date range, zero values mean unbounded
+	Start time.Time
+	End   time.Time
+	// Days (mon, tue...) and From/To (HH:MM, To before From spans midnight) limit the window
+	// to days of the week and a time of the day, in Timezone (default UTC)
+	Days     []string
+	From     string
+	To       string
+	Timezone string
+}
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (r ScheduleRule) applies(user string, account string) bool {
+	if !matchPattern(r.User, user, false) {
+		return false
+	}
+	account = strings.ToLower(account)
+	for _, pattern := range r.Except {
+		if matchPattern(pattern, account, true) {
+			return false
+		}
+	}
+	if len(r.Accounts) == 0 {
+		return true
+	}
+	for _, pattern := range r.Accounts {
+		if matchPattern(pattern, account, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow reports whether t is in the rule window
+func (r ScheduleRule) inWindow(t time.Time) (bool, error) {
+	if !r.Start.IsZero() && t.Before(r.Start) {
+		return false, nil
+	}
+	if !r.End.IsZero() && !t.Before(r.End) {
+		return false, nil
+	}
+	location := time.UTC
+	if r.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(r.Timezone)
+		if err != nil {
+			return false, err
+		}
+	}
+	t = t.In(location)
+	if len(r.Days) > 0 {
+		matched := false
+		for _, day := range r.Days {
+			weekday, ok := scheduleDays[strings.ToLower(day)]
+			if !ok {
+				return false, fmt.Errorf("invalid day %q", day)
+			}
+			matched = matched || weekday == t.Weekday()
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	if r.From == "" && r.To == "" {
+		return true, nil
+	}
+	from, err := parseScheduleTime(r.From)
+	if err != nil {
+		return false, err
+	}
+	to, err := parseScheduleTime(r.To)
+	if err != nil {
+		return false, err
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return minute >= from && minute < to, nil
+	}
+	return minute >= from || minute < to, nil
+}
+
+// parseScheduleTime returns the minutes since midnight of a HH:MM time
+func parseScheduleTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// filterKeysBySchedule drops the keys of accounts not allowed to log in as user at the current time
+func filterKeysBySchedule(rules []ScheduleRule, user string, keys []Key) []Key {
+	if len(rules) == 0 {
+		return keys
+	}
+	t := now()
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		reason := checkSchedule(rules, user, keys[i].Account, t)
+		if reason != "" {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, reason)
+			a, b := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "AUTH", "theo-agent")
+			if b == nil {
+				a.Write([]byte(fmt.Sprintf("Denied key of account %s to log in as %s: %s\n", keys[i].Account, user, reason)))
+			}
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+// checkSchedule returns why account can not log in as user at t, empty when allowed
+func checkSchedule(rules []ScheduleRule, user string, account string, t time.Time) string {
+	for i, rule := range rules {
+		if !rule.applies(user, account) {
+			continue
+		}
+		in, err := rule.inWindow(t)
+		if err != nil {
+			return fmt.Sprintf("schedule rule #%d: %s", i, err)
+		}
+		switch rule.Action {
+		case K_ACCESS_ALLOW:
+			if !in {
+				return fmt.Sprintf("outside of the allowed window of schedule rule #%d", i)
+			}
+		case K_ACCESS_DENY:
+			if in {
+				return fmt.Sprintf("inside the denied window of schedule rule #%d", i)
+			}
+		default:
+			return fmt.Sprintf("schedule rule #%d: invalid action %q", i, rule.Action)
+		}
+	}
+	return ""
+}
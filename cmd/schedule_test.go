@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	defer func(n func() time.Time) {
+		now = n
+	}(now)
+	cfg, ret := parseConfig("../test/config.12.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	if len(cfg.Schedule) != 3 {
+		t.Fatalf("Expected 3 schedule rules, got %d", len(cfg.Schedule))
+	}
+	keys := []Key{
+		{Account: "alice@oncall.example.com"},
+		{Account: "bob@corp.example.com"},
+		{Account: "emergency@corp.example.com"},
+	}
+	tests := []struct {
+		time     string
+		user     string
+		accounts string
+	}{
+		// Tuesday
+		{"2026-10-13T23:30:00Z", "root", "alice@oncall.example.com,bob@corp.example.com,emergency@corp.example.com"},
+		{"2026-10-13T05:59:00Z", "root", "alice@oncall.example.com,bob@corp.example.com,emergency@corp.example.com"},
+		{"2026-10-13T12:00:00Z", "root", "bob@corp.example.com,emergency@corp.example.com"},
+		// change freeze
+		{"2026-12-24T23:30:00Z", "root", "emergency@corp.example.com"},
+		{"2027-01-05T23:30:00Z", "root", "alice@oncall.example.com,bob@corp.example.com,emergency@corp.example.com"},
+		// Friday 23:30 UTC is Saturday in Rome
+		{"2026-10-16T21:30:00Z", "deploy", "alice@oncall.example.com,bob@corp.example.com,emergency@corp.example.com"},
+		{"2026-10-16T23:30:00Z", "deploy", ""},
+	}
+	for _, test := range tests {
+		tm, _ := time.Parse(time.RFC3339, test.time)
+		now = func() time.Time { return tm }
+		filtered := filterKeysBySchedule(cfg.Schedule, test.user, keys)
+		accounts := make([]string, 0, len(filtered))
+		for _, key := range filtered {
+			accounts = append(accounts, key.Account)
+		}
+		if strings.Join(accounts, ",") != test.accounts {
+			t.Errorf("%s as %s: expected %s, got %v", test.time, test.user, test.accounts, accounts)
+		}
+	}
+
+	invalid := []ScheduleRule{
+		{Action: "allow", From: "25:00", To: "06:00"},
+		{Action: "allow", Timezone: "Nowhere/Never"},
+		{Action: "allow", Days: []string{"someday"}},
+		{Action: "maybe"},
+	}
+	for _, rule := range invalid {
+		if filtered := filterKeysBySchedule([]ScheduleRule{rule}, "root", keys); len(filtered) != 0 {
+			t.Errorf("Invalid schedule rule %+v must reject every key", rule)
+		}
+	}
+}
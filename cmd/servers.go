@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	urlu "net/url"
+	"os"
+	"time"
+)
+
+// url_order values
+const (
+	K_URL_ORDER_ORDERED = "ordered"
+	K_URL_ORDER_RANDOM  = "random"
+)
+
+// lastServer is the Theo server which last answered, stored in the cache dir
+type lastServer struct {
+	URL string `json:"url"`
+}
+
+// getTheoURLs returns the Theo servers: -url, or url from config
+func getTheoURLs() []string {
+	if *theoURL != "" {
+		return []string{*theoURL}
+	}
+	return config.URL
+}
+
+func getLastServerFilename() string {
+	return fmt.Sprintf("%s/server.json", getCacheDir())
+}
+
+// getServerOrder returns the order in which the servers are tried: as configured, or with url_order
+// random shuffled, but starting from the last server which answered
+func getServerOrder(urls []string) []string {
+	ordered := append([]string{}, urls...)
+	if config.URLOrder != K_URL_ORDER_RANDOM || len(ordered) < 2 {
+		return ordered
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	last := loadLastServer()
+	for i := 0; i < len(ordered); i++ {
+		if ordered[i] == last {
+			copy(ordered[1:i+1], ordered[:i])
+			ordered[0] = last
+			break
+		}
+	}
+	return ordered
+}
+
+func loadLastServer() string {
+	data, err := ioutil.ReadFile(getLastServerFilename())
+	if err != nil {
+		return ""
+	}
+	var server lastServer
+	if err := json.Unmarshal(data, &server); err != nil {
+		return ""
+	}
+	return server.URL
+}
+
+func saveLastServer(url string) {
+	if loadLastServer() == url {
+		return
+	}
+	lastServerFile := getLastServerFilename()
+	data, _ := json.Marshal(lastServer{URL: url})
+	if err := writeFileAtomic(lastServerFile, data, 0644); err != nil && *debug {
+		fmt.Fprintf(os.Stderr, "Unable to write cache file (%s): %s\n", lastServerFile, err)
+	}
+}
+
+// performFailoverRequest makes the request to each server, see getServerOrder, until one answers.
+// Servers share the timeout, each one getting its share of the time left.
+// It returns the response body and the server which answered. It fails with 9 when no server answered:
+// every server was down, failed with a 5xx or was skipped; otherwise with the error of the last server which answered.
+func performFailoverRequest(method string, urls []string, token string, remotePath string, q urlu.Values, body []byte) ([]byte, int, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), getRequestTimeout())
+	defer cancel()
+	return performFailoverRequestContext(ctx, method, urls, token, remotePath, q, body)
+}
+
+// performFailoverRequestContext is performFailoverRequest within the deadline of ctx, so that
+// several requests made for the same login share a single timeout
+func performFailoverRequestContext(ctx context.Context, method string, urls []string, token string, remotePath string, q urlu.Values, body []byte) ([]byte, int, string) {
+	if len(urls) == 0 {
+		fmt.Fprintf(os.Stderr, "No Theo server URL set\n")
+		return nil, 8, ""
+	}
+	ret := 9
+	order := getServerOrder(urls)
+	for i, url := range order {
+		if ctx.Err() != nil {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "No time left to try %s\n", url)
+			}
+			break
+		}
+		if !allowServerRequest(url) {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Skipping Theo server %s, known down\n", url)
+			}
+			continue
+		}
+		serverCtx, serverCancel := withServerShare(ctx, len(order)-i)
+		respBody, r, transient := performRequestWithRetries(serverCtx, method, url, token, remotePath, q, body)
+		serverCancel()
+		if r == 0 {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Theo server %s answered\n", url)
+			}
+			recordServerHealth(url, true)
+			// Only url_order random starts from the last server which answered
+			if config.URLOrder == K_URL_ORDER_RANDOM {
+				saveLastServer(url)
+			}
+			return respBody, 0, url
+		}
+		if *debug {
+			fmt.Fprintf(os.Stderr, "Theo server %s failed (%d)\n", url, r)
+		}
+		// An error like 404 comes from a server up and running, a 5xx or no answer from a server down
+		recordServerHealth(url, !transient)
+		if !transient {
+			ret = r
+		}
+	}
+	return nil, ret, ""
+}
+
+// getServerLog returns the Theo server which answered, for the syslog audit lines
+func getServerLog(server string) string {
+	if server == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (server %s)", server)
+}
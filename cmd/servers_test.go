@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseConfigURLs(t *testing.T) {
+	cfg, ret := parseConfig("../test/config.14.yml")
+	if ret > 0 {
+		t.Fatalf("Failed to parse config")
+	}
+	if len(cfg.URL) != 2 || cfg.URL[1] != "https://theo-us.example.com" || cfg.URLOrder != K_URL_ORDER_RANDOM {
+		t.Errorf("Unexpected servers %v (%s)", cfg.URL, cfg.URLOrder)
+	}
+	cfg, _ = parseConfig("../test/config.1.yml")
+	if len(cfg.URL) != 1 {
+		t.Errorf("Expected 1 server, got %v", cfg.URL)
+	}
+}
+
+func TestPerformFailoverRequest(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Cachedir = t.TempDir()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer up.Close()
+
+	body, ret, server := performFailoverRequest(http.MethodGet, []string{down.URL, failing.URL, up.URL}, "token", "authorized_keys/host/user", nil, nil)
+	if ret > 0 || server != up.URL || string(body) != "[]" {
+		t.Fatalf("Expected answer from %s, got %s (ret %d)", up.URL, server, ret)
+	}
+	if loadLastServer() != "" {
+		t.Errorf("Last healthy server must not be remembered with url_order ordered")
+	}
+
+	config.URLOrder = K_URL_ORDER_RANDOM
+	if _, ret, _ = performFailoverRequest(http.MethodGet, []string{down.URL, failing.URL, up.URL}, "token", "authorized_keys/host/user", nil, nil); ret > 0 {
+		t.Fatalf("Expected answer from %s, got ret %d", up.URL, ret)
+	}
+	if loadLastServer() != up.URL {
+		t.Errorf("Last healthy server must be remembered")
+	}
+	for i := 0; i < 10; i++ {
+		order := getServerOrder([]string{down.URL, failing.URL, up.URL})
+		if len(order) != 3 || order[0] != up.URL {
+			t.Fatalf("Last healthy server must be tried first, got %v", order)
+		}
+	}
+	config.URLOrder = ""
+	if order := getServerOrder([]string{down.URL, up.URL}); order[0] != down.URL {
+		t.Errorf("Servers must be tried in order, got %v", order)
+	}
+
+	_, ret, server = performFailoverRequest(http.MethodGet, []string{down.URL, failing.URL}, "token", "authorized_keys/host/user", nil, nil)
+	if ret == 0 || server != "" {
+		t.Errorf("Request must fail when every server fails")
+	}
+	if _, ret, _ = performFailoverRequest(http.MethodGet, nil, "token", "authorized_keys/host/user", nil, nil); ret != 8 {
+		t.Errorf("Request without servers must fail with 8, got %d", ret)
+	}
+}
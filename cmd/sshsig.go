@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHSIG signatures, as produced by ssh-keygen -Y sign (see PROTOCOL.sshsig in OpenSSH sources)
+
+const sshsigMagic = "SSHSIG"
+const sshsigArmorType = "SSH SIGNATURE"
+const sshsigArmorStart = "-----BEGIN SSH SIGNATURE-----"
+
+// K_SIGNATURE_NAMESPACE is the default namespace expected in SSHSIG signatures (ssh-keygen -Y sign -n theo)
+const K_SIGNATURE_NAMESPACE = "theo"
+
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+type sshsigSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// sshsigVerifier verifies SSHSIG signatures made by an SSH public key
+type sshsigVerifier struct {
+	PublicKey ssh.PublicKey
+	// Namespaces restricts the accepted namespaces (patterns from allowed_signers), empty means any
+	Namespaces []string
+}
+
+// allowedSignersOptions maps the allowed_signers options to whether they take a value
+var allowedSignersOptions = map[string]bool{
+	"cert-authority": false,
+	"namespaces":     true,
+	"valid-after":    true,
+	"valid-before":   true,
+}
+
+// sshsigKeyTypes are the SSH key types accepted as trusted keys
+var sshsigKeyTypes = map[string]bool{
+	ssh.KeyAlgoED25519:  true,
+	ssh.KeyAlgoECDSA256: true,
+	ssh.KeyAlgoECDSA384: true,
+	ssh.KeyAlgoECDSA521: true,
+	ssh.KeyAlgoRSA:      true,
+}
+
+func isSSHSignature(signature string) bool {
+	return strings.HasPrefix(strings.TrimSpace(signature), sshsigArmorStart)
+}
+
+func getSignatureNamespace() string {
+	if config.SignatureNamespace != "" {
+		return config.SignatureNamespace
+	}
+	return K_SIGNATURE_NAMESPACE
+}
+
+// Verify verifies an armored SSHSIG signature of message
+func (v *sshsigVerifier) Verify(message []byte, signature []byte) error {
+	block, _ := pem.Decode(signature)
+	if block == nil || block.Type != sshsigArmorType {
+		return errors.New("signature is not an armored SSH signature")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(sshsigMagic)) {
+		return errors.New("SSH signature: invalid magic")
+	}
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(block.Bytes[len(sshsigMagic):], &blob); err != nil {
+		return fmt.Errorf("SSH signature: %s", err)
+	}
+	if blob.Version != 1 {
+		return fmt.Errorf("SSH signature: unsupported version %d", blob.Version)
+	}
+	if !bytes.Equal(blob.PublicKey, v.PublicKey.Marshal()) {
+		return errors.New("SSH signature: made by another key")
+	}
+	namespace := getSignatureNamespace()
+	if blob.Namespace != namespace {
+		return fmt.Errorf("SSH signature: namespace %q, expected %q", blob.Namespace, namespace)
+	}
+	if !v.allowsNamespace(namespace) {
+		return fmt.Errorf("SSH signature: namespace %q not allowed for signer", namespace)
+	}
+	var h hash.Hash
+	switch blob.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("SSH signature: unsupported hash algorithm %q", blob.HashAlgorithm)
+	}
+	h.Write(message)
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return fmt.Errorf("SSH signature: %s", err)
+	}
+	if sig.Format == ssh.KeyAlgoRSA {
+		return errors.New("SSH signature: ssh-rsa (SHA-1) signatures are not accepted")
+	}
+	signedData := append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+	return v.PublicKey.Verify(signedData, &sig)
+}
+
+func (v *sshsigVerifier) allowsNamespace(namespace string) bool {
+	if len(v.Namespaces) == 0 {
+		return true
+	}
+	for _, pattern := range v.Namespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowedSigners parses SSH public keys, one per line, either in authorized_keys
+// (keytype key [comment]) or allowed_signers (principals [options] keytype key) format
+func parseAllowedSigners(data []byte, name string) ([]trustedKey, error) {
+	trustedKeys := make([]trustedKey, 0)
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parseAllowedSignersLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", name, i+1, err)
+		}
+		if key.Name == "" {
+			key.Name = name
+		}
+		trustedKeys = append(trustedKeys, key)
+	}
+	if len(trustedKeys) == 0 {
+		return nil, fmt.Errorf("%s does not contains any key", name)
+	}
+	return trustedKeys, nil
+}
+
+func parseAllowedSignersLine(line string) (trustedKey, error) {
+	tokens := splitQuoted(line)
+	if len(tokens) < 2 {
+		return trustedKey{}, errors.New("missing public key")
+	}
+	var principals string
+	var options []sshOption
+	if _, err := parseSSHPublicKeyTokens(tokens); err != nil {
+		principals = strings.Trim(tokens[0], `"`)
+		tokens = tokens[1:]
+		if len(tokens) > 2 {
+			if _, err := parseSSHPublicKeyTokens(tokens); err != nil {
+				options, err = parseOptions(tokens[0], allowedSignersOptions)
+				if err != nil {
+					return trustedKey{}, err
+				}
+				tokens = tokens[1:]
+			}
+		}
+	}
+	pk, err := parseSSHPublicKeyTokens(tokens)
+	if err != nil {
+		return trustedKey{}, err
+	}
+	if !sshsigKeyTypes[pk.Type()] {
+		return trustedKey{}, fmt.Errorf("unsupported key type %s", pk.Type())
+	}
+	verifier := &sshsigVerifier{PublicKey: pk}
+	key := trustedKey{ID: principals, Name: principals, Fingerprint: ssh.FingerprintSHA256(pk), Verifier: verifier}
+	for _, option := range options {
+		switch option.Name {
+		case "cert-authority":
+			return trustedKey{}, errors.New("cert-authority signers are not supported")
+		case "namespaces":
+			verifier.Namespaces = strings.Split(option.Value, ",")
+		case "valid-after":
+			key.NotBefore, err = parseSSHTime(option.Value)
+		case "valid-before":
+			key.NotAfter, err = parseSSHTime(option.Value)
+		}
+		if err != nil {
+			return trustedKey{}, fmt.Errorf("%s: %s", option.Name, err)
+		}
+	}
+	return key, nil
+}
+
+// parseSSHPublicKeyTokens parses the keytype and base64 key at the start of tokens
+func parseSSHPublicKeyTokens(tokens []string) (ssh.PublicKey, error) {
+	if len(tokens) < 2 {
+		return nil, errors.New("missing public key")
+	}
+	pk, _, options, _, err := ssh.ParseAuthorizedKey([]byte(tokens[0] + " " + tokens[1]))
+	if err != nil {
+		return nil, err
+	}
+	if len(options) > 0 {
+		return nil, errors.New("missing public key")
+	}
+	return pk, nil
+}
+
+// splitQuoted splits s on spaces and tabs which are not enclosed in double quotes
+func splitQuoted(s string) []string {
+	tokens := make([]string, 0)
+	inQuote := false
+	start := -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			inQuote = !inQuote
+		}
+		if (c == ' ' || c == '\t') && !inQuote {
+			if start >= 0 {
+				tokens = append(tokens, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// parseSSHTime parses a YYYYMMDD[HHMM[SS]][Z] timestamp, as used by allowed_signers and authorized_keys
+func parseSSHTime(s string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+		location = time.UTC
+		s = s[:len(s)-1]
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(s)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return time.ParseInLocation(layout, s, location)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+const testSSHSigner = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO signer-ed25519@theo"
+
+func TestSSHSIGAllowedSigners(t *testing.T) {
+	userCacheFile := "../test/test.signature-sshsig.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	keys = validateKeys(keys)
+	if len(keys) != 4 {
+		t.Fatalf("Keys len must be %d, got %d", 4, len(keys))
+	}
+	verified, err := verifyKeys(newPublicKeyList("../test/allowed_signers"), keys, "test", "test-host")
+	if err != nil {
+		t.Errorf("Failed to verify keys")
+	}
+	if len(verified) != 3 {
+		t.Fatalf("Keys len must be %d, got %d", 3, len(verified))
+	}
+	for i := 0; i < len(verified); i++ {
+		if verified[i].Account != keys[i].Account {
+			t.Errorf("Key #%d (%s) should not be verified", i, verified[i].Account)
+		}
+	}
+	verified, _ = verifyKeys(newPublicKeyList("../test/allowed_signers"), keys, "test", "other-host")
+	if len(verified) != 0 {
+		t.Errorf("Keys len must be %d, got %d", 0, len(verified))
+	}
+}
+
+func TestSSHSIGNamespace(t *testing.T) {
+	userCacheFile := "../test/test.signature-sshsig.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	verified, _ := verifyKeys(newPublicKeyList(testSSHSigner), keys, "test", "test-host")
+	if len(verified) != 1 || verified[0].Account != "ed25519@example.com" {
+		t.Errorf("Only ed25519@example.com must be verified, got %d keys", len(verified))
+	}
+
+	config.SignatureNamespace = "other"
+	defer func() {
+		config.SignatureNamespace = ""
+	}()
+	verified, _ = verifyKeys(newPublicKeyList(testSSHSigner), keys, "test", "test-host")
+	if len(verified) != 1 || verified[0].Account != "namespace@example.com" {
+		t.Errorf("Only namespace@example.com must be verified, got %d keys", len(verified))
+	}
+	// allowed_signers restricts the ed25519 signer to the theo namespace
+	verified, _ = verifyKeys(newPublicKeyList("../test/allowed_signers"), keys, "test", "test-host")
+	if len(verified) != 0 {
+		t.Errorf("Keys len must be %d, got %d", 0, len(verified))
+	}
+}
+
+func TestParseAllowedSignersLine(t *testing.T) {
+	key, err := parseAllowedSignersLine(`"a@theo,b@theo" namespaces="theo",valid-after="20200101",valid-before="202101021030Z" ` + testSSHSigner)
+	if err != nil {
+		t.Fatalf("parseAllowedSignersLine failed: %s", err)
+	}
+	if key.Name != "a@theo,b@theo" {
+		t.Errorf("Unexpected principals %q", key.Name)
+	}
+	if !key.NotAfter.Equal(time.Date(2021, 1, 2, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected valid-before %s", key.NotAfter)
+	}
+	if key.isValidAt(time.Now()) {
+		t.Errorf("Key must not be valid after valid-before")
+	}
+	invalid := []string{
+		"ssh-ed25519",
+		"a@theo cert-authority " + testSSHSigner,
+		`a@theo valid-after="yesterday" ` + testSSHSigner,
+		`a@theo unknown="x" ` + testSSHSigner,
+		"a@theo ssh-dss AAAAB3NzaC1kc3MAAACBAP",
+	}
+	for _, line := range invalid {
+		if _, err := parseAllowedSignersLine(line); err == nil {
+			t.Errorf("parseAllowedSignersLine(%q) should fail", line)
+		}
+	}
+}
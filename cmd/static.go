@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Key sources, see Key.Source
+const (
+	K_SOURCE_THEO        = "theo"
+	K_SOURCE_CACHE       = "cache"
+	K_SOURCE_BREAK_GLASS = "break_glass"
+	K_SOURCE_CONFIG      = "config"
+)
+
+// setKeysSource tags keys with the source they come from
+func setKeysSource(keys []Key, source string) []Key {
+	for i := 0; i < len(keys); i++ {
+		keys[i].Source = source
+	}
+	return keys
+}
+
+// loadStaticKeys returns the static keys of user: static_keys from config, then the
+// keys in static_keys_dir/<user>/*.json (same format as Theo server responses)
+func loadStaticKeys(user string) []Key {
+	keys := make([]Key, 0)
+	keys = append(keys, setKeysSource(append([]Key{}, config.StaticKeys[user]...), K_SOURCE_CONFIG)...)
+	if config.StaticKeysDir == "" {
+		return keys
+	}
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/\\") {
+		fmt.Fprintf(os.Stderr, "Ignoring static keys dir for invalid user %q\n", user)
+		return keys
+	}
+	files, _ := filepath.Glob(filepath.Join(config.StaticKeysDir, user, "*.json"))
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read static keys (%s): %s\n", file, err)
+			continue
+		}
+		var fileKeys []Key
+		if err := json.Unmarshal(data, &fileKeys); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to parse static keys (%s): %s\n", file, err)
+			continue
+		}
+		keys = append(keys, setKeysSource(fileKeys, file)...)
+	}
+	return keys
+}
+
+// mergeStaticKeys appends staticKeys to keys, skipping the ones already present:
+// sshd uses the first matching line, so the options of the key from Theo win
+func mergeStaticKeys(keys []Key, staticKeys []Key) []Key {
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if fingerprint, err := getKeyFingerprint(key.PublicKey); err == nil {
+			seen[fingerprint] = true
+		}
+	}
+	for _, key := range staticKeys {
+		fingerprint, err := getKeyFingerprint(key.PublicKey)
+		if err == nil && seen[fingerprint] {
+			if *debug {
+				fmt.Fprintf(os.Stderr, "Skipping duplicate static key %s (%s)\n", fingerprint, key.Source)
+			}
+			continue
+		}
+		if err == nil {
+			seen[fingerprint] = true
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func getKeySource(key Key) string {
+	if key.Source == K_SOURCE_THEO {
+		return getServerLog(key.Server)
+	}
+	if key.Source == "" || key.Source == K_SOURCE_CACHE {
+		return ""
+	}
+	return fmt.Sprintf(" (source %s)", key.Source)
+}
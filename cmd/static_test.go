@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticKeys(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "backup"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "backup", "10-ci.json"), []byte(`[{"public_key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO ci", "email": "ci@example.com"}]`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "backup", "20-broken.json"), []byte(`not json`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "backup", "README"), []byte(`ignored`), 0644)
+
+	config.StaticKeysDir = dir
+	config.StaticKeys = map[string][]Key{
+		"backup": {
+			{PublicKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIN8g05+ZeElAFktcrUpUyuAsfoNrPk4eH+T2Z20KdBrA macno@jalapeno", Account: "macno@example.com"},
+		},
+	}
+	staticKeys := loadStaticKeys("backup")
+	if len(staticKeys) != 2 {
+		t.Fatalf("Expected 2 static keys, got %d", len(staticKeys))
+	}
+	if staticKeys[0].Source != K_SOURCE_CONFIG || staticKeys[1].Source != filepath.Join(dir, "backup", "10-ci.json") {
+		t.Errorf("Unexpected sources %s, %s", staticKeys[0].Source, staticKeys[1].Source)
+	}
+	if len(config.StaticKeys["backup"][0].Source) != 0 {
+		t.Errorf("Static keys in config must not be modified")
+	}
+
+	ret, keys := loadCacheFile("../test/test.signature-v2.json")
+	if ret > 0 {
+		t.Fatalf("Failed to read cached keys")
+	}
+	keys = setKeysSource(keys, K_SOURCE_CACHE)
+	merged := mergeStaticKeys(keys, staticKeys)
+	if len(merged) != len(keys)+1 {
+		t.Fatalf("Expected %d keys, got %d", len(keys)+1, len(merged))
+	}
+	for i := range keys {
+		if merged[i].Source != K_SOURCE_CACHE {
+			t.Errorf("Key #%d must come from cache, got %s", i, merged[i].Source)
+		}
+	}
+	if last := merged[len(merged)-1]; last.Account != "ci@example.com" || getKeySource(last) == "" {
+		t.Errorf("Unexpected static key %+v", last)
+	}
+
+	if keys := loadStaticKeys("../backup"); len(keys) != 0 {
+		t.Errorf("Static keys dir must not be read for invalid users")
+	}
+	if keys := loadStaticKeys("root"); len(keys) != 0 {
+		t.Errorf("Expected no static key for root, got %d", len(keys))
+	}
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const pemPublicKeyStart = "-----BEGIN PUBLIC KEY-----"
+
+// trustedKey is a public key allowed to sign the keys returned by the server
+type trustedKey struct {
+	// ID is the key ID set in config, or the principals of an allowed_signers entry
+	ID string
+	// Name is the path the key was loaded from, "inline" when embedded in config
+	// or the principals of an allowed_signers entry
+	Name        string
+	Fingerprint string
+	Verifier    Verifier
+	// NotBefore and NotAfter, when set, limit when the key is trusted
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (k trustedKey) String() string {
+	if k.ID != "" && k.ID != k.Name {
+		return fmt.Sprintf("%s %s (%s)", k.ID, k.Name, k.Fingerprint)
+	}
+	return fmt.Sprintf("%s (%s)", k.Name, k.Fingerprint)
+}
+
+// hasID reports whether keyID, as referenced by a signature, designates this key
+func (k trustedKey) hasID(keyID string) bool {
+	return keyID == k.ID || keyID == k.Fingerprint
+}
+
+func (k trustedKey) isValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// loadTrustedKeys parses every configured public key once, skipping unusable, expired and duplicate keys.
+// Each entry is a PEM public key, SSH public keys in allowed_signers format, or the path of a file containing them.
+func loadTrustedKeys(publicKeys PublicKeyList) []trustedKey {
+	trustedKeys := make([]trustedKey, 0, len(publicKeys))
+	seen := make(map[string]bool)
+	for i := 0; i < len(publicKeys); i++ {
+		publicKey := strings.Trim(publicKeys[i].Key, " ")
+		if publicKey == "" {
+			continue
+		}
+		name := "inline"
+		data := []byte(publicKey)
+		if !isInlinePublicKey(publicKey) {
+			var err error
+			name = publicKey
+			data, err = ioutil.ReadFile(publicKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not load public key: %v\n", err)
+				continue
+			}
+		}
+		keys, err := parseTrustedKeys(data, name, publicKeys[i].Algorithm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not parse public key: %v\n", err)
+			continue
+		}
+		for _, key := range keys {
+			key.restrict(publicKeys[i])
+			if !key.isValidAt(now()) {
+				if *debug {
+					fmt.Fprintf(os.Stderr, "Skipping public key %s outside its validity period\n", key)
+				}
+				continue
+			}
+			if seen[key.Fingerprint] {
+				if *debug {
+					fmt.Fprintf(os.Stderr, "Skipping duplicate public key %s\n", key)
+				}
+				continue
+			}
+			seen[key.Fingerprint] = true
+			trustedKeys = append(trustedKeys, key)
+		}
+	}
+	return trustedKeys
+}
+
+// restrict applies the key ID and the validity period set in config
+func (k *trustedKey) restrict(entry PublicKeyEntry) {
+	if entry.ID != "" {
+		k.ID = entry.ID
+	}
+	if !entry.NotBefore.IsZero() && entry.NotBefore.After(k.NotBefore) {
+		k.NotBefore = entry.NotBefore
+	}
+	if !entry.NotAfter.IsZero() && (k.NotAfter.IsZero() || entry.NotAfter.Before(k.NotAfter)) {
+		k.NotAfter = entry.NotAfter
+	}
+}
+
+func isInlinePublicKey(publicKey string) bool {
+	return strings.HasPrefix(publicKey, pemPublicKeyStart) || strings.ContainsAny(publicKey, " \t\n")
+}
+
+func parseTrustedKeys(data []byte, name string, algorithm string) ([]trustedKey, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte(pemPublicKeyStart)) {
+		if algorithm != "" {
+			return nil, fmt.Errorf("%s: algorithm %q not supported by SSH keys", name, algorithm)
+		}
+		return parseAllowedSigners(data, name)
+	}
+	fingerprint, err := pemFingerprint(data)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := parsePublicKeyWithAlgorithm(data, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return []trustedKey{{Name: name, Fingerprint: fingerprint, Verifier: verifier}}, nil
+}
+
+// pemFingerprint returns the SHA256 of the DER encoded key (SubjectPublicKeyInfo), written "SHA256:<base64>".
+// It is not the ssh-keygen fingerprint of the key: get it with
+// openssl pkey -pubin -in public.pem -outform DER | openssl dgst -sha256 -binary | base64 (without the trailing =)
+func pemFingerprint(pemBytes []byte) (string, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return "", errors.New("public key file does not contains any key")
+	}
+	return derFingerprint(block.Bytes), nil
+}
+
+func derFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// matchesSSHKey reports whether pk is this key, comparing fingerprints: SSH fingerprints for
+// allowed_signers keys, fingerprints of the DER encoded key for PEM keys
+func (k trustedKey) matchesSSHKey(pk ssh.PublicKey) bool {
+	if k.Fingerprint == ssh.FingerprintSHA256(pk) {
+		return true
+	}
+	cpk, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return false
+	}
+	der, err := x509.MarshalPKIXPublicKey(cpk.CryptoPublicKey())
+	if err != nil {
+		return false
+	}
+	return k.Fingerprint == derFingerprint(der)
+}
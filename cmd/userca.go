@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SignedTrustedUserCAKeys is the object returned by theo-node: the CA keys trusted to sign
+// user certificates, in authorized_keys format, and their signatures
+type SignedTrustedUserCAKeys struct {
+	TrustedUserCAKeys string         `json:"trusted_user_ca_keys"`
+	Signature         string         `json:"signature"`
+	KeyID             string         `json:"key_id,omitempty"`
+	Signatures        []KeySignature `json:"signatures,omitempty"`
+}
+
+// trustedUserCAPayload is the wire encoded message signed by the server
+type trustedUserCAPayload struct {
+	Magic             string
+	TrustedUserCAKeys string
+}
+
+const trustedUserCAMagic = "theo-agent-user-ca-v1"
+
+// K_TRUSTED_USER_CA_KEYS_CRON is the crontab entry suggested at install to refresh the user CA keys,
+// followed by -trusted-user-ca-keys-path
+const K_TRUSTED_USER_CA_KEYS_CRON = "23 * * * * root /usr/sbin/theo-agent -with-user-certificates"
+
+// installTrustedUserCAKeys fetches the user CA keys from Theo server and writes them to -trusted-user-ca-keys-path
+func installTrustedUserCAKeys() {
+	ret := writeTrustedUserCAKeys([]string{*theoURL}, *theoAccessToken)
+	if ret > 0 {
+		os.Exit(ret)
+	}
+	fmt.Fprintf(os.Stderr, "Trusted user CA keys must be refreshed when they change, add to /etc/cron.d/theo-agent:\n\n%s -trusted-user-ca-keys-path %s\n\n", K_TRUSTED_USER_CA_KEYS_CRON, *trustedUserCAKeysPath)
+}
+
+// RefreshTrustedUserCAKeys fetches the user CA keys from Theo servers and writes them to -trusted-user-ca-keys-path.
+// It must run periodically, see K_TRUSTED_USER_CA_KEYS_CRON.
+func RefreshTrustedUserCAKeys() {
+	var ret int
+	config, ret = parseConfig("")
+	if ret > 0 {
+		os.Exit(ret)
+	}
+	_theoToken := config.Token
+	if *theoAccessToken != "" {
+		_theoToken = *theoAccessToken
+	}
+	os.Exit(writeTrustedUserCAKeys(getTheoURLs(), _theoToken))
+}
+
+// writeTrustedUserCAKeys fetches the user CA keys and writes them to -trusted-user-ca-keys-path,
+// the file is left as it is when they can not be fetched
+func writeTrustedUserCAKeys(urls []string, token string) int {
+	body, ret, server := performFailoverRequest(http.MethodGet, urls, token, "trusted_user_ca", nil, nil)
+	if ret > 0 {
+		fmt.Fprintf(os.Stderr, "Unable to retrieve trusted user CA keys from %s\n", strings.Join(urls, ", "))
+		return ret
+	}
+	caKeys, err := parseTrustedUserCAKeys(body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid trusted user CA keys from %s: %s\n", server, err)
+		return 9
+	}
+	err = writeFileAtomic(*trustedUserCAKeysPath, []byte(caKeys), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write trusted user CA keys (%s): %s\n", *trustedUserCAKeysPath, err)
+		return 21
+	}
+	return 0
+}
+
+// parseTrustedUserCAKeys decodes a SignedTrustedUserCAKeys, verifying its signature when -verify is on,
+// and returns the CA keys, one per line
+func parseTrustedUserCAKeys(data []byte) (string, error) {
+	var signed SignedTrustedUserCAKeys
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return "", err
+	}
+	if mustVerify() {
+		if err := verifyTrustedUserCAKeys(signed); err != nil {
+			return "", err
+		}
+	}
+	lines := make([]string, 0)
+	for i, line := range strings.Split(signed.TrustedUserCAKeys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if j := indexControlChar(line); j >= 0 {
+			return "", fmt.Errorf("line %d contains control character %q at offset %d", i+1, line[j], j)
+		}
+		pk, _, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return "", fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if len(options) > 0 || len(rest) > 0 {
+			return "", fmt.Errorf("line %d: options are not allowed", i+1)
+		}
+		if err := checkSSHKeyType(line, pk); err != nil {
+			return "", fmt.Errorf("line %d: %s", i+1, err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "", errors.New("no CA key")
+	}
+	return fmt.Sprintf("%s\n", strings.Join(lines, "\n")), nil
+}
+
+// verifyTrustedUserCAKeys checks the CA keys have been signed by verify_quorum trusted keys
+func verifyTrustedUserCAKeys(signed SignedTrustedUserCAKeys) error {
+	trustedKeys := loadTrustedKeys(getPublicKeys())
+	payload := ssh.Marshal(trustedUserCAPayload{Magic: trustedUserCAMagic, TrustedUserCAKeys: signed.TrustedUserCAKeys})
+	verifiedBy := verifySignatures(trustedKeys, payload, getSignatures(signed.Signature, signed.KeyID, signed.Signatures))
+	quorum := getVerifyQuorum(loadHostname())
+	if len(verifiedBy) < quorum {
+		return fmt.Errorf("trusted user CA keys signed by %d trusted keys, %d required", len(verifiedBy), quorum)
+	}
+	if *debug {
+		fmt.Fprintf(os.Stderr, "Trusted user CA keys verified by %s\n", strings.Join(verifiedBy, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedUserCAKeys(t *testing.T) {
+	defer func(c Config) {
+		config = c
+	}(config)
+	config.Verify = true
+	config.PublicKey = newPublicKeyList("../test/public-ed25519.pem")
+
+	data, err := ioutil.ReadFile("../test/test.trusted_user_ca.json")
+	if err != nil {
+		t.Fatalf("Failed to read trusted user CA keys: %s", err)
+	}
+	caKeys, err := parseTrustedUserCAKeys(data)
+	if err != nil {
+		t.Fatalf("parseTrustedUserCAKeys failed: %s", err)
+	}
+	if strings.Count(caKeys, "\n") != 2 {
+		t.Errorf("Expected 2 CA keys, got %q", caKeys)
+	}
+
+	tampered := strings.Replace(string(data), "theo-user-ca-2", "evil-ca", 1)
+	if _, err := parseTrustedUserCAKeys([]byte(tampered)); err == nil {
+		t.Errorf("Tampered trusted user CA keys must be rejected")
+	}
+
+	config.PublicKey = newPublicKeyList("../test/public-ed25519-2.pem")
+	if _, err := parseTrustedUserCAKeys(data); err == nil {
+		t.Errorf("Trusted user CA keys signed by an untrusted key must be rejected")
+	}
+
+	config.Verify = false
+	unsigned := `{"trusted_user_ca_keys": "cert-authority ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1FMmNLYsAHlHIwYngkVhYOS1TMXZJVplVZNfeab8dO\n"}`
+	if _, err := parseTrustedUserCAKeys([]byte(unsigned)); err == nil {
+		t.Errorf("Trusted user CA keys with options must be rejected")
+	}
+}
+
+func TestWriteTrustedUserCAKeys(t *testing.T) {
+	defer func(c Config, path string) {
+		config = c
+		*trustedUserCAKeysPath = path
+	}(config, *trustedUserCAKeysPath)
+	config.Cachedir = t.TempDir()
+	*trustedUserCAKeysPath = filepath.Join(config.Cachedir, "theo_user_ca_keys")
+
+	data, _ := ioutil.ReadFile("../test/test.trusted_user_ca.json")
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/trusted_user_ca" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer up.Close()
+
+	if ret := writeTrustedUserCAKeys([]string{down.URL, up.URL}, "token"); ret > 0 {
+		t.Fatalf("Trusted user CA keys must be fetched from the next server, got %d", ret)
+	}
+	caKeys, _ := ioutil.ReadFile(*trustedUserCAKeysPath)
+	if strings.Count(string(caKeys), "\n") != 2 {
+		t.Errorf("Expected 2 CA keys, got %q", caKeys)
+	}
+
+	up.Close()
+	if ret := writeTrustedUserCAKeys([]string{down.URL, up.URL}, "token"); ret == 0 {
+		t.Errorf("Refresh must fail when every server is down")
+	}
+	if kept, _ := ioutil.ReadFile(*trustedUserCAKeysPath); string(kept) != string(caKeys) {
+		t.Errorf("CA keys must be kept when they can not be refreshed")
+	}
+}
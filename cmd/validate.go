@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshOption is a single authorized_keys option, e.g. no-pty or from="10.0.0.0/8"
+type sshOption struct {
+	Name     string
+	Value    string
+	HasValue bool
+}
+
+// knownSSHOptions maps the authorized_keys options understood by OpenSSH to whether they take a value
+var knownSSHOptions = map[string]bool{
+	"agent-forwarding":    false,
+	"cert-authority":      false,
+	"command":             true,
+	"environment":         true,
+	"expiry-time":         true,
+	"from":                true,
+	"no-agent-forwarding": false,
+	"no-port-forwarding":  false,
+	"no-pty":              false,
+	"no-touch-required":   false,
+	"no-user-rc":          false,
+	"no-x11-forwarding":   false,
+	"permitlisten":        true,
+	"permitopen":          true,
+	"port-forwarding":     false,
+	"principals":          true,
+	"pty":                 false,
+	"restrict":            false,
+	"tunnel":              true,
+	"user-rc":             false,
+	"verify-required":     false,
+	"x11-forwarding":      false,
+}
+
+// validateKeys drops every key that cannot be safely written to authorized_keys, reporting why
+func validateKeys(keys []Key) []Key {
+	retKeys := make([]Key, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		err := validateKey(keys[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Rejected key #%d (account %q): %s\n", i, keys[i].Account, err)
+			continue
+		}
+		retKeys = append(retKeys, keys[i])
+	}
+	return retKeys
+}
+
+type keyField struct {
+	name  string
+	value string
+}
+
+func validateKey(key Key) error {
+	fields := []keyField{
+		{"public_key", key.PublicKey},
+		{"email", key.Account},
+		{"ssh_options", key.SSHOptions},
+		{"not_before", key.NotBefore},
+		{"expires_at", key.ExpiresAt},
+	}
+	for _, field := range fields {
+		if i := indexControlChar(field.value); i >= 0 {
+			return fmt.Errorf("%s contains control character %q at offset %d", field.name, field.value[i], i)
+		}
+	}
+	if err := validateSignature(key.PublicKeySig); err != nil {
+		return fmt.Errorf("public_key_sig: %s", err)
+	}
+	for _, signature := range key.Signatures {
+		if err := validateSignature(signature.Signature); err != nil {
+			return fmt.Errorf("signatures: %s", err)
+		}
+	}
+	pk, _, options, rest, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+	if err != nil {
+		return fmt.Errorf("public_key: %s", err)
+	}
+	if len(options) > 0 {
+		return errors.New("public_key must not contain options, use ssh_options")
+	}
+	if len(rest) > 0 {
+		return errors.New("public_key contains more than one key")
+	}
+	if err := checkSSHKeyType(key.PublicKey, pk); err != nil {
+		return fmt.Errorf("public_key: %s", err)
+	}
+	if _, err := parseSSHOptions(key.SSHOptions); err != nil {
+		return fmt.Errorf("ssh_options: %s", err)
+	}
+	if _, _, err := getKeyValidity(key); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateSignature accepts hex encoded and armored SSHSIG signatures
+func validateSignature(signature string) error {
+	if isSSHSignature(signature) {
+		block, rest := pem.Decode([]byte(signature))
+		if block == nil || block.Type != sshsigArmorType || len(bytes.TrimSpace(rest)) > 0 {
+			return errors.New("invalid armored SSH signature")
+		}
+		return nil
+	}
+	if _, err := hex.DecodeString(signature); err != nil {
+		return err
+	}
+	return nil
+}
+
+func indexControlChar(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseSSHOptions parses the option list of an authorized_keys line, as documented in sshd(8)
+func parseSSHOptions(s string) ([]sshOption, error) {
+	return parseOptions(s, knownSSHOptions)
+}
+
+// parseOptions parses a comma separated list of name or name="value" options,
+// known maps the accepted option names to whether they take a value
+func parseOptions(s string, known map[string]bool) ([]sshOption, error) {
+	options := make([]sshOption, 0)
+	i := 0
+	for i < len(s) {
+		start := i
+		for i < len(s) && isOptionNameChar(s[i]) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("unexpected character %q at offset %d", s[i], i)
+		}
+		option := sshOption{Name: strings.ToLower(s[start:i])}
+		takesValue, isKnown := known[option.Name]
+		if !isKnown {
+			return nil, fmt.Errorf("unknown option %q", option.Name)
+		}
+		if i < len(s) && s[i] == '=' {
+			if i+1 >= len(s) || s[i+1] != '"' {
+				return nil, fmt.Errorf("value of option %q must be quoted", option.Name)
+			}
+			i += 2
+			var value strings.Builder
+			closed := false
+			for i < len(s) {
+				if s[i] == '\\' && i+1 < len(s) && s[i+1] == '"' {
+					value.WriteByte('"')
+					i += 2
+					continue
+				}
+				if s[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated value for option %q", option.Name)
+			}
+			option.Value = value.String()
+			option.HasValue = true
+		}
+		if takesValue != option.HasValue {
+			if takesValue {
+				return nil, fmt.Errorf("option %q requires a value", option.Name)
+			}
+			return nil, fmt.Errorf("option %q does not take a value", option.Name)
+		}
+		options = append(options, option)
+		if i < len(s) {
+			if s[i] != ',' || i+1 == len(s) {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", s[i], i)
+			}
+			i++
+		}
+	}
+	return options, nil
+}
+
+func isOptionNameChar(c byte) bool {
+	return c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// formatSSHOptions is the inverse of parseSSHOptions
+func formatSSHOptions(options []sshOption) string {
+	parts := make([]string, 0, len(options))
+	for _, option := range options {
+		if option.HasValue {
+			parts = append(parts, fmt.Sprintf("%s=\"%s\"", option.Name, strings.ReplaceAll(option.Value, "\"", "\\\"")))
+		} else {
+			parts = append(parts, option.Name)
+		}
+	}
+	return strings.Join(parts, ",")
+}
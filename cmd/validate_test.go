@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestValidateKeysInjection(t *testing.T) {
+	userCacheFile := "../test/test.injection.json"
+	ret, keys := loadCacheFile(userCacheFile)
+	if ret > 0 {
+		t.Errorf("Failed to read cached keys")
+	}
+	keys = validateKeys(keys)
+	if len(keys) != 1 {
+		t.Fatalf("Keys len must be %d, got %d", 1, len(keys))
+	}
+	if keys[0].Account != "macno@example.com" {
+		t.Errorf("Unexpected key accepted: %s", keys[0].Account)
+	}
+}
+
+func TestParseSSHOptions(t *testing.T) {
+	valid := map[string]string{
+		"":                                     "",
+		"no-pty":                               "no-pty",
+		"No-Port-Forwarding,no-X11-forwarding": "no-port-forwarding,no-x11-forwarding",
+		`from="192.168.2.1,10.10.0.0"`:         `from="192.168.2.1,10.10.0.0"`,
+		`command="echo \"hi there\"",restrict`: `command="echo \"hi there\"",restrict`,
+	}
+	for in, out := range valid {
+		options, err := parseSSHOptions(in)
+		if err != nil {
+			t.Errorf("parseSSHOptions(%q) failed: %s", in, err)
+			continue
+		}
+		if formatted := formatSSHOptions(options); formatted != out {
+			t.Errorf("formatSSHOptions(parseSSHOptions(%q)) = %q, expected %q", in, formatted, out)
+		}
+	}
+	invalid := []string{
+		"no-pty,",
+		",no-pty",
+		"no-pty no-pty",
+		"from=10.0.0.1",
+		`from="10.0.0.1`,
+		"from",
+		`no-pty="yes"`,
+		"unknown",
+	}
+	for _, in := range invalid {
+		if _, err := parseSSHOptions(in); err == nil {
+			t.Errorf("parseSSHOptions(%q) should fail", in)
+		}
+	}
+}